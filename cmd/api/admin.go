@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// adminRoutes returns the handler of the -admin-addr listener, which serves what operators
+// need but the public mustn't see: profiles, expvar, metrics and control of the log level.
+// Every request must carry the admin credentials.
+func (a *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", a.metrics.registry.Handler())
+	mux.HandleFunc("/log-level", a.logLevelHandler)
+
+	return a.requestID(a.requireAdmin(mux))
+}
+
+// requireAdmin only lets requests through with the static token given by -admin-token, as
+// a bearer token, or the username and password given by -admin-username and
+// -admin-password, with basic authentication.
+func (a *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if a.config.admin.token != "" {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		if a.config.admin.password != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="greenlight admin"`)
+		}
+		a.authenticationRequiredResponse(w, r)
+	})
+}
+
+func (a *application) isAdmin(r *http.Request) bool {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		return a.config.admin.token != "" && secretsEqual(token, a.config.admin.token)
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || a.config.admin.password == "" {
+		return false
+	}
+	// Both are compared, whatever the outcome of the first, so the time taken doesn't tell
+	// which one was wrong.
+	usernameMatches := secretsEqual(username, a.config.admin.username)
+	passwordMatches := secretsEqual(password, a.config.admin.password)
+	return usernameMatches && passwordMatches
+}
+
+// secretsEqual compares secrets in constant time. Hashing them first means not even their
+// lengths leak.
+func secretsEqual(given, want string) bool {
+	givenHash := sha256.Sum256([]byte(given))
+	wantHash := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(givenHash[:], wantHash[:]) == 1
+}
+
+// logLevelHandler shows the minimum level of the entries logged, and changes it when sent a
+// PUT request such as {"level": "ERROR"}, until the application restarts.
+func (a *application) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var input struct {
+			Level string `json:"level"`
+		}
+
+		err := a.readJSON(w, r, &input)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		level, err := jsonlog.ParseLevel(input.Level)
+		v := validator.New()
+		if v.Check(err == nil, "level", "must be one of DEBUG, INFO, WARN, ERROR, FATAL or OFF"); !v.Valid() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		a.setLogLevel(a.loggerFor(r), level)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		a.methodNotAllowedResponse(w, r)
+		return
+	}
+
+	err := a.writeJson(w, http.StatusOK, envelop{"level": a.logger.Level().String()}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// setLogLevel changes the minimum level of the entries logged by every logger of the
+// application. The change is logged through logger, with the level lowered to INFO for the
+// entry if need be, so raising the level leaves a record of when the logs went quiet.
+func (a *application) setLogLevel(logger *jsonlog.Logger, level jsonlog.Level) {
+	previous := a.logger.Level()
+	if previous > jsonlog.LevelInfo {
+		a.logger.SetLevel(jsonlog.LevelInfo)
+	}
+	if level < a.logger.Level() {
+		a.logger.SetLevel(level)
+	}
+	logger.PrintInfo("log level changed", map[string]any{
+		"from": previous.String(),
+		"to":   level.String(),
+	})
+	a.logger.SetLevel(level)
+}
+
+// toggleDebugLogging switches the log level to DEBUG on every signal received, or back to the
+// -log-level it was started with when it already is DEBUG, so verbose logs can be turned on
+// and off with SIGHUP on hosts without the admin listener.
+func (a *application) toggleDebugLogging(signals <-chan os.Signal) {
+	for s := range signals {
+		level := jsonlog.LevelDebug
+		if a.logger.Level() == jsonlog.LevelDebug {
+			level = a.config.log.level
+		}
+		a.setLogLevel(a.logger.With(map[string]any{"signal": s.String()}), level)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
+	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// batchResponseHeaders are the sub-response headers included in a batch's results.
+var batchResponseHeaders = []string{"Location", "ETag", "Idempotent-Replayed"}
+
+// errBatchFailed rolls back an atomic batch in which a sub-request failed.
+var errBatchFailed = errors.New("batch sub-request failed")
+
+type batchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type batchResult struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// batchResponseWriter records the response to a sub-request.
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *batchResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *batchResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *batchResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.body.Write(b)
+}
+
+func (rw *batchResponseWriter) result() batchResult {
+	result := batchResult{Status: rw.status, Body: json.RawMessage("null")}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+
+	if json.Valid(rw.body.Bytes()) {
+		result.Body = json.RawMessage(bytes.TrimSpace(rw.body.Bytes()))
+	}
+
+	for _, name := range batchResponseHeaders {
+		if value := rw.header.Get(name); value != "" {
+			if result.Headers == nil {
+				result.Headers = make(map[string]string)
+			}
+			result.Headers[name] = value
+		}
+	}
+
+	return result
+}
+
+func validateBatchRequest(v *validator.Validator, i int, req batchRequest) {
+	key := fmt.Sprintf("requests[%d]", i)
+
+	v.Check(validator.PermittedValue(req.Method, http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete), key+".method", "must be one of GET, POST, PATCH or DELETE")
+
+	// Only movie requests can be batched, and the path must already be clean so that the
+	// router doesn't redirect it somewhere else.
+	u, err := url.Parse(req.Path)
+	validPath := err == nil && u.Scheme == "" && u.Host == "" && path.Clean(u.Path) == u.Path &&
+		(u.Path == "/v1/movies" || strings.HasPrefix(u.Path, "/v1/movies/"))
+	v.Check(validPath, key+".path", "must be a /v1/movies path")
+}
+
+// batchHandler runs several movie requests sent in a single POST /v1/batch request, so
+// clients on slow networks can save round trips. Every sub-request is dispatched through
+// router in the order given, as the user who sent the batch, and its status, body and
+// headers such as Location and ETag are returned in the same order.
+//
+// An atomic batch runs inside a single transaction, and stops and rolls back at the first
+// sub-request which fails with a 4xx or 5xx status. The sub-requests of a batch aren't rate
+// limited on their own, which is why the number of sub-requests per batch is limited.
+func (a *application) batchHandler(router http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Atomic   bool           `json:"atomic"`
+			Requests []batchRequest `json:"requests"`
+		}
+
+		err := a.readJSON(w, r, &input)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		v := validator.New()
+		v.Check(len(input.Requests) > 0, "requests", "must contain at least 1 request")
+		v.Check(len(input.Requests) <= a.config.batch.maxRequests, "requests", fmt.Sprintf("must not contain more than %d requests", a.config.batch.maxRequests))
+		for i, req := range input.Requests {
+			validateBatchRequest(v, i, req)
+		}
+
+		if !v.Valid() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Sub-requests reuse the batch's context, which carries its authenticated user.
+		base := a.contextSetBatched(r)
+
+		dispatch := func(models data.Models, req batchRequest) (batchResult, error) {
+			ctx, span := trace.Start(base.Context(), "batch sub-request", trace.KindInternal,
+				trace.String("http.request.method", req.Method),
+				trace.String("url.path", req.Path),
+			)
+			defer span.End()
+
+			var body io.Reader = http.NoBody
+			if req.Body != nil && string(req.Body) != "null" {
+				body = bytes.NewReader(req.Body)
+			}
+
+			sub, err := http.NewRequestWithContext(ctx, req.Method, req.Path, body)
+			if err != nil {
+				return batchResult{}, err
+			}
+			for name, value := range req.Headers {
+				sub.Header.Set(name, value)
+			}
+			sub.RemoteAddr = r.RemoteAddr
+			sub = a.contextSetModels(sub, models)
+
+			rw := &batchResponseWriter{header: make(http.Header)}
+			router.ServeHTTP(rw, sub)
+
+			result := rw.result()
+			span.SetAttributes(trace.Int("http.response.status_code", result.Status))
+			return result, nil
+		}
+
+		results := make([]batchResult, 0, len(input.Requests))
+		env := envelop{}
+
+		if !input.Atomic {
+			for _, req := range input.Requests {
+				result, err := dispatch(a.modelsFor(r), req)
+				if err != nil {
+					a.serverErrorResponse(w, r, err)
+					return
+				}
+				results = append(results, result)
+			}
+		} else {
+			err = a.modelsFor(r).WithTx(r.Context(), func(tx data.Models) error {
+				for _, req := range input.Requests {
+					result, err := dispatch(tx, req)
+					if err != nil {
+						return err
+					}
+					results = append(results, result)
+
+					if result.Status >= http.StatusBadRequest {
+						return errBatchFailed
+					}
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errBatchFailed) {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+
+			// Responses to the sub-requests which ran before a failure are still returned,
+			// but none of their changes were kept.
+			env["committed"] = err == nil
+		}
+
+		env["responses"] = results
+
+		err = a.writeJson(w, http.StatusOK, env, nil)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  bool
+		body   string
+		status int
+	}{
+		{
+			name:   "Sequential",
+			token:  true,
+			body:   `{"requests": [{"method": "POST", "path": "/v1/movies", "body": {"title": "Up", "year": 2009, "run_time": "96 mins", "genres": ["animation"]}}, {"method": "GET", "path": "/v1/movies/4"}, {"method": "PATCH", "path": "/v1/movies/4", "headers": {"If-Match": "\"4-1\""}, "body": {"year": 2010}}, {"method": "DELETE", "path": "/v1/movies/42"}, {"method": "GET", "path": "/v1/movies?title=up&sort=-id"}]}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "Atomic",
+			token:  true,
+			body:   `{"atomic": true, "requests": [{"method": "POST", "path": "/v1/movies", "body": {"title": "Up", "year": 2009, "run_time": "96 mins", "genres": ["animation"]}}, {"method": "DELETE", "path": "/v1/movies/3"}]}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "AtomicRolledBack",
+			token:  true,
+			body:   `{"atomic": true, "requests": [{"method": "DELETE", "path": "/v1/movies/3"}, {"method": "PATCH", "path": "/v1/movies/1", "body": {"year": 3000}}, {"method": "DELETE", "path": "/v1/movies/2"}]}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "FailedValidation",
+			token:  true,
+			body:   `{"requests": [{"method": "PUT", "path": "/v1/movies/1"}, {"method": "GET", "path": "/v1/users"}, {"method": "GET", "path": "/v1/movies/../tokens/authentication"}, {"method": "GET", "path": "https://example.com/v1/movies"}]}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "TooManyRequests",
+			token:  true,
+			body:   `{"requests": [` + strings.Repeat(`{"method": "GET", "path": "/v1/movies/1"}, `, 5) + `{"method": "GET", "path": "/v1/movies/1"}]}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "Empty",
+			token:  true,
+			body:   `{"requests": []}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "Anonymous",
+			body:   `{"requests": [{"method": "GET", "path": "/v1/movies/1"}]}`,
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			seedMovies(t, app)
+
+			token := ""
+			if tt.token {
+				token = authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+			}
+
+			res := ts.do(t, http.MethodPost, "/v1/batch", token, tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+
+	// Nothing done by the rolled back batch is kept.
+	t.Run("RolledBackChangesDiscarded", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app)
+		seedMovies(t, app)
+		token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+		ts.do(t, http.MethodPost, "/v1/batch", token, `{"atomic": true, "requests": [{"method": "DELETE", "path": "/v1/movies/3"}, {"method": "DELETE", "path": "/v1/movies/42"}]}`, nil)
+
+		res := ts.do(t, http.MethodGet, "/v1/movies/3", token, "", nil)
+		assertStatus(t, res, http.StatusOK)
+	})
+
+	// Sub-requests aren't rate limited on their own, only the batch is.
+	t.Run("RateLimit", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.config.limiter.enabled = true
+		app.config.limiter.rps = 1
+		app.config.limiter.burst = 1
+		ts := newTestServer(t, app)
+		seedMovies(t, app)
+		token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+		res := ts.do(t, http.MethodPost, "/v1/batch", token, `{"requests": [{"method": "GET", "path": "/v1/movies/1"}, {"method": "GET", "path": "/v1/movies/2"}]}`, nil)
+		assertStatus(t, res, http.StatusOK)
+		if strings.Contains(string(res.body), `"status": 429`) {
+			t.Errorf("sub-request was rate limited: %s", res.body)
+		}
+
+		res = ts.do(t, http.MethodPost, "/v1/batch", token, `{"requests": [{"method": "GET", "path": "/v1/movies/1"}]}`, nil)
+		assertStatus(t, res, http.StatusTooManyRequests)
+	})
+}
@@ -3,14 +3,48 @@ package main
 import (
 	"context"
 	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
 	"net/http"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	modelsContextKey = contextKey("models")
+	batchContextKey  = contextKey("batch")
+	routeContextKey  = contextKey("route")
+	requestIDKey     = contextKey("request_id")
+	requestInfoKey   = contextKey("request_info")
+)
+
+// requestInfo collects what is learned about a request while it is routed and handled, for
+// the middleware wrapping the router, which only sees the request as it was beforehand. The
+// first user and route recorded win, so the sub-requests of a batch don't overwrite those of
+// the batch itself.
+type requestInfo struct {
+	user  *data.User
+	route string
+}
+
+// contextSetRequestInfo returns a request carrying a requestInfo, reusing the one it already
+// carries if any.
+func (a *application) contextSetRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return r, info
+	}
+
+	info := &requestInfo{}
+	ctx := context.WithValue(r.Context(), requestInfoKey, info)
+	return r.WithContext(ctx), info
+}
 
 func (a *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok && info.user == nil {
+		info.user = user
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -23,3 +57,81 @@ func (a *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// contextSetRequestID records the ID which correlates a request with its logs and response.
+func (a *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the ID of the request, or an empty string outside the
+// requestID middleware.
+func (a *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// loggerFor returns a logger which adds the request's ID, the ID of its trace when it is
+// recorded, and the ID of the user making it once authenticated, to every entry. Middleware
+// wrapping the router finds the user in the request's requestInfo.
+func (a *application) loggerFor(r *http.Request) *jsonlog.Logger {
+	properties := make(map[string]any)
+	if id := a.contextGetRequestID(r); id != "" {
+		properties["request_id"] = id
+	}
+	if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+		properties["trace_id"] = span.SpanContext().TraceID.String()
+	}
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if info, recorded := r.Context().Value(requestInfoKey).(*requestInfo); !ok && recorded {
+		user, ok = info.user, info.user != nil
+	}
+	if ok && !user.IsAnonymous() {
+		properties["user_id"] = user.ID
+	}
+
+	return a.logger.With(properties)
+}
+
+// contextSetModels returns a request whose handlers use models, such as a copy bound to the
+// transaction of an atomic batch, instead of the application's models.
+func (a *application) contextSetModels(r *http.Request, models data.Models) *http.Request {
+	ctx := context.WithValue(r.Context(), modelsContextKey, models)
+	return r.WithContext(ctx)
+}
+
+// modelsFor returns the models handlers should use for the request.
+func (a *application) modelsFor(r *http.Request) data.Models {
+	models, ok := r.Context().Value(modelsContextKey).(data.Models)
+	if !ok {
+		return a.models
+	}
+
+	return models
+}
+
+// contextSetBatched marks a request as a sub-request of a batch.
+func (a *application) contextSetBatched(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), batchContextKey, true)
+	return r.WithContext(ctx)
+}
+
+func (a *application) contextIsBatched(r *http.Request) bool {
+	batched, _ := r.Context().Value(batchContextKey).(bool)
+	return batched
+}
+
+// contextSetRoute records the entry of the route table a request was routed to.
+func (a *application) contextSetRoute(r *http.Request, rt route) *http.Request {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok && info.route == "" {
+		info.route = rt.path
+	}
+
+	ctx := context.WithValue(r.Context(), routeContextKey, rt)
+	return r.WithContext(ctx)
+}
+
+func (a *application) contextGetRoute(r *http.Request) (route, bool) {
+	rt, ok := r.Context().Value(routeContextKey).(route)
+	return rt, ok
+}
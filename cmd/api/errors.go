@@ -1,20 +1,119 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+const problemMediaType = "application/problem+json"
+
+// problem is an RFC 9457 problem details object. Code is the stable machine-readable code of
+// the helper which sent the response, RequestID the X-Request-ID of the request, and Errors
+// holds the messages of failed validations.
+type problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail"`
+	Instance  string         `json:"instance"`
+	Code      string         `json:"code"`
+	RequestID string         `json:"request_id,omitempty"`
+	Errors    []problemError `json:"errors,omitempty"`
+}
+
+type problemError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
 func (a *application) logError(r *http.Request, err error) {
-	a.logger.PrintError(err, map[string]string{
+	a.loggerFor(r).PrintError(err, map[string]any{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
-func (a *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelop{"error": message}
-	err := a.writeJson(w, status, env, nil)
+// wantsProblem reports whether errors should be sent as problem details, because the server
+// runs with -problem-json or the client lists application/problem+json in its Accept header.
+func (a *application) wantsProblem(r *http.Request) bool {
+	if a.config.problemJSON {
+		return true
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err == nil && mediaType == problemMediaType && acceptable(params) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptable reports whether the parameters of a media range in an Accept header leave it
+// acceptable, which it isn't when its quality value is 0 or doesn't parse.
+func acceptable(params map[string]string) bool {
+	q, ok := params["q"]
+	if !ok {
+		return true
+	}
+
+	weight, err := strconv.ParseFloat(q, 64)
+	return err == nil && weight > 0
+}
+
+// newProblem returns the problem details of an error. Its type is about:blank, leaving code
+// to identify the error, unless -problem-type-base points to where problem types are
+// documented, which then prefixes the lower-case, hyphenated code, as in
+// https://example.com/problems/not-found.
+func (a *application) newProblem(r *http.Request, status int, code string, message any) problem {
+	problemType := "about:blank"
+	if a.config.problemTypeBase != "" {
+		problemType = a.config.problemTypeBase + strings.ToLower(strings.ReplaceAll(code, "_", "-"))
+	}
+
+	p := problem{
+		Type:      problemType,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: a.contextGetRequestID(r),
+	}
+
+	switch message := message.(type) {
+	case map[string]string:
+		p.Detail = "the request failed validation"
+		for field, detail := range message {
+			p.Errors = append(p.Errors, problemError{Field: field, Detail: detail})
+		}
+		sort.Slice(p.Errors, func(i, j int) bool { return p.Errors[i].Field < p.Errors[j].Field })
+	default:
+		p.Detail = fmt.Sprint(message)
+	}
+
+	return p
+}
+
+// errorResponse sends message, either a string or validation errors keyed by field, as
+// {"error": message}, or as problem details identified by code when the client wants them.
+// Both carry the request's ID, so a client can quote it when reporting the error.
+func (a *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message any) {
+	var err error
+	if a.wantsProblem(r) {
+		err = a.writeJson(w, status, a.newProblem(r, status, code, message), http.Header{"Content-Type": {problemMediaType}})
+	} else {
+		env := envelop{"error": message}
+		if id := a.contextGetRequestID(r); id != "" {
+			env["request_id"] = id
+		}
+		err = a.writeJson(w, status, env, nil)
+	}
 	if err != nil {
 		a.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -22,55 +121,100 @@ func (a *application) errorResponse(w http.ResponseWriter, r *http.Request, stat
 }
 
 func (a *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	// The client went away before we finished, so there is nobody left to respond to.
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		a.loggerFor(r).PrintInfo("request cancelled by client", map[string]any{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+		})
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		a.logError(r, err)
+		a.timeoutResponse(w, r)
+		return
+	}
+
 	a.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
-	a.errorResponse(w, r, http.StatusInternalServerError, message)
+	a.errorResponse(w, r, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", message)
+}
+
+func (a *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server timed out while processing your request, please try again"
+	a.errorResponse(w, r, http.StatusGatewayTimeout, "TIMEOUT", message)
 }
 
 func (a *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	a.errorResponse(w, r, http.StatusNotFound, message)
+	a.errorResponse(w, r, http.StatusNotFound, "NOT_FOUND", message)
 }
 
 func (a *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	a.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	a.errorResponse(w, r, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", message)
 }
 
 func (a *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	a.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	a.errorResponse(w, r, http.StatusBadRequest, "BAD_REQUEST", err.Error())
 }
 
 func (a *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	a.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	a.errorResponse(w, r, http.StatusUnprocessableEntity, "FAILED_VALIDATION", errors)
 }
 
 func (a *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	a.errorResponse(w, r, http.StatusConflict, message)
+	a.errorResponse(w, r, http.StatusConflict, "EDIT_CONFLICT", message)
+}
+
+func (a *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since you last fetched it, fetch the latest version and try again"
+	a.errorResponse(w, r, http.StatusPreconditionFailed, "PRECONDITION_FAILED", message)
+}
+
+func (a *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Patch", mergePatchMediaType+", "+jsonPatchMediaType)
+	message := fmt.Sprintf("the request body must be sent as %s or %s", mergePatchMediaType, jsonPatchMediaType)
+	a.errorResponse(w, r, http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE", message)
+}
+
+func (a *application) patchConflictResponse(w http.ResponseWriter, r *http.Request, err error) {
+	a.errorResponse(w, r, http.StatusConflict, "PATCH_CONFLICT", err.Error())
+}
+
+func (a *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "a request with the same idempotency key is still being processed, please try again"
+	a.errorResponse(w, r, http.StatusConflict, "IDEMPOTENCY_KEY_IN_USE", message)
+}
+
+func (a *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the idempotency key has already been used for a different request"
+	a.errorResponse(w, r, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_MISMATCH", message)
 }
 
 func (a *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	a.errorResponse(w, r, http.StatusTooManyRequests, message)
+	a.errorResponse(w, r, http.StatusTooManyRequests, "RATE_LIMIT_EXCEEDED", message)
 }
 
 func (a *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	a.errorResponse(w, r, http.StatusUnauthorized, message)
+	a.errorResponse(w, r, http.StatusUnauthorized, "INVALID_CREDENTIALS", message)
 }
 
 func (a *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	message := "invalid or missing authentication token"
-	a.errorResponse(w, r, http.StatusUnauthorized, message)
+	a.errorResponse(w, r, http.StatusUnauthorized, "INVALID_TOKEN", message)
 }
 
 func (a *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	a.errorResponse(w, r, http.StatusUnauthorized, message)
+	a.errorResponse(w, r, http.StatusUnauthorized, "UNAUTHENTICATED", message)
 }
 func (a *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	a.errorResponse(w, r, http.StatusForbidden, message)
+	a.errorResponse(w, r, http.StatusForbidden, "INACTIVE_ACCOUNT", message)
 }
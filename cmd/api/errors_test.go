@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	tests := []struct {
+		name        string
+		problemJSON bool
+		method      string
+		path        string
+		token       bool
+		body        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"NotFound", false, http.MethodGet, "/v1/movies/42", true, "", "application/problem+json", http.StatusNotFound, problemMediaType},
+		{"FailedValidation", false, http.MethodPost, "/v1/movies", true, `{"title": "", "year": 1800}`, "application/json, application/problem+json", http.StatusUnprocessableEntity, problemMediaType},
+		{"Unauthenticated", false, http.MethodGet, "/v1/movies/1", false, "", "application/problem+json", http.StatusUnauthorized, problemMediaType},
+		{"ServerFlag", true, http.MethodDelete, "/v1/healthcheck", false, "", "", http.StatusMethodNotAllowed, problemMediaType},
+		{"Declined", false, http.MethodGet, "/v1/movies/42", true, "", "application/json, application/problem+json;q=0", http.StatusNotFound, "application/json"},
+		{"DeclinedDecimal", false, http.MethodGet, "/v1/movies/42", true, "", "application/json, application/problem+json;q=0.0", http.StatusNotFound, "application/json"},
+		{"Weighted", false, http.MethodGet, "/v1/movies/42", true, "", "application/json;q=0.5, application/problem+json;q=0.9", http.StatusNotFound, problemMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.problemJSON = tt.problemJSON
+			ts := newTestServer(t, app)
+			seedMovies(t, app)
+
+			var token string
+			if tt.token {
+				token = authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+			}
+
+			res := ts.do(t, tt.method, tt.path, token, tt.body, map[string]string{"Accept": tt.accept})
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+			if got := res.header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q; want %q", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestProblemTypeBase(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.problemJSON = true
+	app.config.problemTypeBase = "https://docs.example.com/problems/"
+	ts := newTestServer(t, app)
+
+	res := ts.do(t, http.MethodGet, "/v1/nowhere", "", "", nil)
+	assertStatus(t, res, http.StatusNotFound)
+
+	var p problem
+	if err := json.Unmarshal(res.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != "https://docs.example.com/problems/not-found" || p.Code != "NOT_FOUND" {
+		t.Errorf("got type %q and code %q", p.Type, p.Code)
+	}
+}
@@ -0,0 +1,891 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphqlError is an error returned to GraphQL clients, with a machine-readable code in its
+// extensions. Failed validations also list the offending fields, using the same keys and
+// messages as the REST endpoints.
+type graphqlError struct {
+	code    string
+	message string
+	fields  map[string]string
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]any {
+	extensions := map[string]any{"code": e.code}
+	if e.fields != nil {
+		extensions["fields"] = e.fields
+	}
+	return extensions
+}
+
+var (
+	errGraphQLNotFound               = &graphqlError{code: "NOT_FOUND", message: "the requested resource could not be found"}
+	errGraphQLAuthenticationRequired = &graphqlError{code: "UNAUTHENTICATED", message: "you must be authenticated to access this resource"}
+	errGraphQLInactiveAccount        = &graphqlError{code: "FORBIDDEN", message: "your user account must be activated to access this resource"}
+	errGraphQLEditConflict           = &graphqlError{code: "EDIT_CONFLICT", message: "unable to update the record due to an edit conflict, please try again"}
+	errGraphQLPreconditionFailed     = &graphqlError{code: "PRECONDITION_FAILED", message: "the record has been modified since you last fetched it, fetch the latest version and try again"}
+	errGraphQLInvalidCredentials     = &graphqlError{code: "INVALID_CREDENTIALS", message: "invalid authentication credentials"}
+)
+
+func graphqlValidationError(errors map[string]string) error {
+	return &graphqlError{code: "FAILED_VALIDATION", message: "the input failed validation", fields: errors}
+}
+
+func graphqlBadInputError(err error) error {
+	return &graphqlError{code: "BAD_USER_INPUT", message: err.Error()}
+}
+
+// graphqlServerError logs an unexpected error and hides its details from the client, as
+// serverErrorResponse does.
+func (a *application) graphqlServerError(r *http.Request, err error) error {
+	a.logError(r, err)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &graphqlError{code: "TIMEOUT", message: "the server timed out while processing your request, please try again"}
+	}
+	return &graphqlError{code: "INTERNAL_SERVER_ERROR", message: "the server encountered a problem and could not process your request"}
+}
+
+// graphqlRequest returns the HTTP request a resolver is running for.
+func graphqlRequest(p graphql.ResolveParams) *http.Request {
+	return p.Info.RootValue.(map[string]any)["request"].(*http.Request)
+}
+
+// graphqlRequireActivatedUser is the resolver equivalent of requireActivatedUser.
+func (a *application) graphqlRequireActivatedUser(r *http.Request) error {
+	user := a.contextGetUser(r)
+
+	switch {
+	case user.IsAnonymous():
+		return errGraphQLAuthenticationRequired
+	case !user.Activated:
+		return errGraphQLInactiveAccount
+	}
+	return nil
+}
+
+// graphqlID parses the ID argument of a field. IDs which aren't valid never match a record,
+// so they resolve to ErrRecordNotFound.
+func graphqlID(p graphql.ResolveParams) (int64, error) {
+	id, err := strconv.ParseInt(fmt.Sprint(p.Args["id"]), 10, 64)
+	if err != nil || id < 1 {
+		return 0, data.ErrRecordNotFound
+	}
+	return id, nil
+}
+
+// graphqlDate parses the date argument arg of a field, reporting errors under key as
+// readDate does.
+func graphqlDate(p graphql.ResolveParams, arg, key string, v *validator.Validator) data.Date {
+	s, _ := p.Args[arg].(string)
+	if s == "" {
+		return data.Date{}
+	}
+	d, err := data.ParseDate(s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+		return data.Date{}
+	}
+
+	return d
+}
+
+// graphqlMovieFields maps the fields of the MovieInput type to the keys of movieInput.
+var graphqlMovieFields = map[string]string{
+	"title":            "title",
+	"year":             "year",
+	"runtime":          "run_time",
+	"genres":           "genres",
+	"synopsis":         "synopsis",
+	"rating":           "rating",
+	"releaseDate":      "release_date",
+	"originalLanguage": "original_language",
+}
+
+// graphqlMoviePatch turns a MovieInput argument into a JSON Merge Patch for movieInput, so
+// mutations go through the same decoding and validation as REST requests. Fields left out
+// are kept. graphql-go drops null input values, so fields are cleared by setting them to an
+// empty string instead.
+func graphqlMoviePatch(input map[string]any) ([]byte, error) {
+	patch := make(map[string]any, len(input))
+
+	for name, value := range input {
+		switch {
+		case value == "":
+			value = nil
+		case name == "runtime":
+			value = fmt.Sprintf("%d mins", value)
+		}
+		patch[graphqlMovieFields[name]] = value
+	}
+
+	return json.Marshal(patch)
+}
+
+// graphqlEditMovie applies a MovieInput argument to movie and validates the result.
+func graphqlEditMovie(movie *data.Movie, input any) error {
+	fields, _ := input.(map[string]any)
+
+	patch, err := graphqlMoviePatch(fields)
+	if err != nil {
+		return err
+	}
+
+	var edited movieInput
+	err = applyPatch(newMovieInput(movie), mergePatchMediaType, patch, &edited)
+	if err != nil {
+		return graphqlBadInputError(err)
+	}
+	edited.copyTo(movie)
+
+	v := validator.New()
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return graphqlValidationError(v.Errors)
+	}
+	return nil
+}
+
+// graphqlExpectedVersion checks the expectedVersion argument of a mutation against movie,
+// the GraphQL equivalent of the X-Expected-Version header. It reports whether the argument
+// was given.
+func graphqlExpectedVersion(p graphql.ResolveParams, movie *data.Movie) (bool, error) {
+	expected, ok := p.Args["expectedVersion"].(int)
+	if !ok {
+		return false, nil
+	}
+
+	if expected < 1 {
+		return true, graphqlValidationError(map[string]string{"expectedVersion": "must be a positive integer"})
+	}
+	if int32(expected) != movie.Version {
+		return true, errGraphQLPreconditionFailed
+	}
+	return true, nil
+}
+
+// graphqlField returns a field of an object type which resolves to the value returned by
+// resolve for its source.
+func graphqlField[T any](typ graphql.Output, resolve func(T) any) *graphql.Field {
+	return &graphql.Field{
+		Type: typ,
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return resolve(p.Source.(T)), nil
+		},
+	}
+}
+
+// graphqlOptional returns nil for an empty optional value, which GraphQL sends as null.
+func graphqlOptional[T comparable](value T) any {
+	var zero T
+	if value == zero {
+		return nil
+	}
+	return value
+}
+
+// graphqlSchema builds the schema served by graphqlHandler. Its resolvers go through the
+// same models, validation and permission checks as the REST handlers, so every movie field
+// requires an activated user while me and the account mutations are open to anyone, and
+// me returns null for anonymous users. Movies have no cast or crew in the data model, so
+// there are no credits to expose yet.
+func (a *application) graphqlSchema() (graphql.Schema, error) {
+	movieType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Movie",
+		Fields: graphql.Fields{
+			"id":               graphqlField(graphql.NewNonNull(graphql.ID), func(m *data.Movie) any { return m.ID }),
+			"title":            graphqlField(graphql.NewNonNull(graphql.String), func(m *data.Movie) any { return m.Title }),
+			"year":             graphqlField(graphql.NewNonNull(graphql.Int), func(m *data.Movie) any { return int(m.Year) }),
+			"runtime":          graphqlField(graphql.NewNonNull(graphql.Int), func(m *data.Movie) any { return int(m.RunTime) }),
+			"genres":           graphqlField(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), func(m *data.Movie) any { return m.Genres }),
+			"synopsis":         graphqlField(graphql.String, func(m *data.Movie) any { return graphqlOptional(m.Synopsis) }),
+			"rating":           graphqlField(graphql.String, func(m *data.Movie) any { return graphqlOptional(m.Rating) }),
+			"releaseDate":      graphqlField(graphql.String, func(m *data.Movie) any { return graphqlOptional(m.ReleaseDate.String()) }),
+			"originalLanguage": graphqlField(graphql.String, func(m *data.Movie) any { return graphqlOptional(m.OriginalLanguage) }),
+			"version":          graphqlField(graphql.NewNonNull(graphql.Int), func(m *data.Movie) any { return int(m.Version) }),
+		},
+	})
+
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metadata",
+		Fields: graphql.Fields{
+			"currentPage":  graphqlField(graphql.NewNonNull(graphql.Int), func(m data.Metadata) any { return m.CurrentPage }),
+			"pageSize":     graphqlField(graphql.NewNonNull(graphql.Int), func(m data.Metadata) any { return m.PageSize }),
+			"firstPage":    graphqlField(graphql.NewNonNull(graphql.Int), func(m data.Metadata) any { return m.FirstPage }),
+			"lastPage":     graphqlField(graphql.NewNonNull(graphql.Int), func(m data.Metadata) any { return m.LastPage }),
+			"totalRecords": graphqlField(graphql.NewNonNull(graphql.Int), func(m data.Metadata) any { return m.TotalRecords }),
+		},
+	})
+
+	movieListType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MovieList",
+		Fields: graphql.Fields{
+			"movies":   graphqlField(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(movieType))), func(l envelop) any { return l["movies"] }),
+			"metadata": graphqlField(graphql.NewNonNull(metadataType), func(l envelop) any { return l["metadata"] }),
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        graphqlField(graphql.NewNonNull(graphql.ID), func(u *data.User) any { return u.ID }),
+			"name":      graphqlField(graphql.NewNonNull(graphql.String), func(u *data.User) any { return u.Name }),
+			"email":     graphqlField(graphql.NewNonNull(graphql.String), func(u *data.User) any { return u.Email }),
+			"activated": graphqlField(graphql.NewNonNull(graphql.Boolean), func(u *data.User) any { return u.Activated }),
+			"createdAt": graphqlField(graphql.NewNonNull(graphql.DateTime), func(u *data.User) any { return u.CreatedAt }),
+		},
+	})
+
+	authenticationTokenType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AuthenticationToken",
+		Fields: graphql.Fields{
+			"token":  graphqlField(graphql.NewNonNull(graphql.String), func(t *data.Token) any { return t.Plaintext }),
+			"expiry": graphqlField(graphql.NewNonNull(graphql.DateTime), func(t *data.Token) any { return t.Expiry }),
+		},
+	})
+
+	movieInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MovieInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":            &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"year":             &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"runtime":          &graphql.InputObjectFieldConfig{Type: graphql.Int, Description: "Runtime in minutes"},
+			"genres":           &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"synopsis":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"rating":           &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"releaseDate":      &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Release date in YYYY-MM-DD format"},
+			"originalLanguage": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"movie": &graphql.Field{
+				Type: movieType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: a.resolveMovie,
+			},
+			"movies": &graphql.Field{
+				Type: movieListType,
+				Args: graphql.FieldConfigArgument{
+					"title":          &graphql.ArgumentConfig{Type: graphql.String},
+					"genres":         &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"rating":         &graphql.ArgumentConfig{Type: graphql.String},
+					"releasedAfter":  &graphql.ArgumentConfig{Type: graphql.String},
+					"releasedBefore": &graphql.ArgumentConfig{Type: graphql.String},
+					"page":           &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"pageSize":       &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultPageSize},
+					"sort":           &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "id"},
+				},
+				Resolve: a.resolveMovies,
+			},
+			"me": &graphql.Field{
+				Type:    userType,
+				Resolve: a.resolveMe,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createMovie": &graphql.Field{
+				Type: movieType,
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(movieInputType)},
+				},
+				Resolve: a.resolveCreateMovie,
+			},
+			"updateMovie": &graphql.Field{
+				Type: movieType,
+				Args: graphql.FieldConfigArgument{
+					"id":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(movieInputType)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: a.resolveUpdateMovie,
+			},
+			"deleteMovie": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"id":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: a.resolveDeleteMovie,
+			},
+			"registerUser": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"name":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"email":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: a.resolveRegisterUser,
+			},
+			"activateUser": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"token": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: a.resolveActivateUser,
+			},
+			"createAuthenticationToken": &graphql.Field{
+				Type: authenticationTokenType,
+				Args: graphql.FieldConfigArgument{
+					"email":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: a.resolveCreateAuthenticationToken,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// resolveMovie returns the movie with the given ID, or null if there isn't one.
+func (a *application) resolveMovie(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	if err := a.graphqlRequireActivatedUser(r); err != nil {
+		return nil, err
+	}
+
+	id, err := graphqlID(p)
+	if err != nil {
+		return nil, nil
+	}
+
+	movie, err := a.modelsFor(r).Movies.Get(p.Context, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	return movie, nil
+}
+
+func (a *application) resolveMovies(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	if err := a.graphqlRequireActivatedUser(r); err != nil {
+		return nil, err
+	}
+
+	var input movieListInput
+	v := validator.New()
+
+	input.Title, _ = p.Args["title"].(string)
+	input.Rating, _ = p.Args["rating"].(string)
+	input.Genres = []string{}
+	if genres, ok := p.Args["genres"].([]any); ok {
+		for _, genre := range genres {
+			input.Genres = append(input.Genres, genre.(string))
+		}
+	}
+
+	input.ReleasedAfter = graphqlDate(p, "releasedAfter", "released_after", v)
+	input.ReleasedBefore = graphqlDate(p, "releasedBefore", "released_before", v)
+	input.Filters.Page, _ = p.Args["page"].(int)
+	input.Filters.PageSize, _ = p.Args["pageSize"].(int)
+	input.Filters.Sort, _ = p.Args["sort"].(string)
+	input.Filters.SortSafeList = movieSortSafeList
+
+	if validateMovieListInput(v, &input); !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	movies, metadata, err := a.modelsFor(r).Movies.GetAll(p.Context, input.Title, input.Genres, input.Rating, input.ReleasedAfter, input.ReleasedBefore, input.Filters)
+	if err != nil {
+		return nil, a.graphqlServerError(r, err)
+	}
+
+	return envelop{"movies": movies, "metadata": metadata}, nil
+}
+
+// resolveMe returns the user who sent the request, or null for anonymous users.
+func (a *application) resolveMe(p graphql.ResolveParams) (any, error) {
+	user := a.contextGetUser(graphqlRequest(p))
+	if user.IsAnonymous() {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func (a *application) resolveCreateMovie(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	if err := a.graphqlRequireActivatedUser(r); err != nil {
+		return nil, err
+	}
+
+	movie := &data.Movie{}
+	if err := graphqlEditMovie(movie, p.Args["input"]); err != nil {
+		return nil, err
+	}
+
+	err := a.modelsFor(r).Movies.Insert(p.Context, movie)
+	if err != nil {
+		return nil, a.graphqlServerError(r, err)
+	}
+
+	return movie, nil
+}
+
+func (a *application) resolveUpdateMovie(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	if err := a.graphqlRequireActivatedUser(r); err != nil {
+		return nil, err
+	}
+
+	id, err := graphqlID(p)
+	if err != nil {
+		return nil, errGraphQLNotFound
+	}
+
+	movie, err := a.modelsFor(r).Movies.Get(data.WithPrimary(p.Context), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errGraphQLNotFound
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	conditional, err := graphqlExpectedVersion(p, movie)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := graphqlEditMovie(movie, p.Args["input"]); err != nil {
+		return nil, err
+	}
+
+	err = a.modelsFor(r).Movies.Update(p.Context, movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			return nil, errGraphQLPreconditionFailed
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, errGraphQLEditConflict
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	return movie, nil
+}
+
+func (a *application) resolveDeleteMovie(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	if err := a.graphqlRequireActivatedUser(r); err != nil {
+		return nil, err
+	}
+
+	id, err := graphqlID(p)
+	if err != nil {
+		return nil, errGraphQLNotFound
+	}
+
+	// As with DELETE requests, only a conditional delete loads the movie first.
+	var version int32
+	if _, ok := p.Args["expectedVersion"]; ok {
+		movie, err := a.modelsFor(r).Movies.Get(data.WithPrimary(p.Context), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, errGraphQLNotFound
+			default:
+				return nil, a.graphqlServerError(r, err)
+			}
+		}
+
+		if _, err := graphqlExpectedVersion(p, movie); err != nil {
+			return nil, err
+		}
+		version = movie.Version
+	}
+
+	err = a.modelsFor(r).Movies.Delete(p.Context, id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errGraphQLNotFound
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, errGraphQLPreconditionFailed
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (a *application) resolveRegisterUser(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+
+	user := &data.User{Activated: false}
+	user.Name, _ = p.Args["name"].(string)
+	user.Email, _ = p.Args["email"].(string)
+	password, _ := p.Args["password"].(string)
+
+	err := user.Password.Set(p.Context, password)
+	if err != nil {
+		return nil, a.graphqlServerError(r, err)
+	}
+
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	var token *data.Token
+	err = a.modelsFor(r).WithTx(p.Context, func(tx data.Models) error {
+		err := tx.Users.Insert(p.Context, user)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(p.Context, user.ID, 3*24*time.Hour, data.ScopeActivation)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			return nil, graphqlValidationError(v.Errors)
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	a.sendWelcomeEmail(r, user, token)
+
+	return user, nil
+}
+
+func (a *application) resolveActivateUser(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	plaintext, _ := p.Args["token"].(string)
+
+	v := validator.New()
+	if data.ValidateTokenPlainText(v, plaintext); !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	user, err := a.modelsFor(r).Users.GetForToken(p.Context, data.ScopeActivation, plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			return nil, graphqlValidationError(v.Errors)
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	// Activate a copy, so user still matches the store if the transaction rolls back.
+	activated := *user
+	activated.Activated = true
+
+	err = a.modelsFor(r).WithTx(p.Context, func(tx data.Models) error {
+		err := tx.Users.Update(p.Context, &activated)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(p.Context, data.ScopeActivation, activated.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, errGraphQLEditConflict
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	return &activated, nil
+}
+
+func (a *application) resolveCreateAuthenticationToken(p graphql.ResolveParams) (any, error) {
+	r := graphqlRequest(p)
+	email, _ := p.Args["email"].(string)
+	password, _ := p.Args["password"].(string)
+
+	v := validator.New()
+	data.ValidateEmail(v, email)
+	data.ValidatePasswordPlaintext(v, password)
+	if !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	user, err := a.modelsFor(r).Users.GetByEmail(p.Context, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errGraphQLInvalidCredentials
+		default:
+			return nil, a.graphqlServerError(r, err)
+		}
+	}
+
+	match, err := user.Password.Matches(p.Context, password)
+	if err != nil {
+		return nil, a.graphqlServerError(r, err)
+	}
+	if !match {
+		return nil, errGraphQLInvalidCredentials
+	}
+
+	token, err := a.modelsFor(r).Tokens.New(p.Context, user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return nil, a.graphqlServerError(r, err)
+	}
+
+	return token, nil
+}
+
+const (
+	// graphqlDefaultPageSize is the page size of the movies field when none is given, as
+	// for GET /v1/movies.
+	graphqlDefaultPageSize = 20
+
+	// graphqlMaxIntrospectionDepth leaves room for the nested ofType fields of the
+	// introspection query sent by GraphiQL and similar tools.
+	graphqlMaxIntrospectionDepth = 16
+)
+
+// graphqlCost measures the depth and complexity of an operation before it runs, so that
+// a single request can't make the server do an unbounded amount of work. Every field costs
+// 1, and the fields selected under a page of movies are counted once per movie in the
+// page. Introspection fields add to the complexity too, but their depth is capped
+// separately by graphqlMaxIntrospectionDepth, as clients nest ofType deeper than any
+// query over movies needs.
+type graphqlCost struct {
+	// introspectionDepth is the depth of the deepest introspection field, measured from
+	// the root of the operation.
+	introspectionDepth int
+
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+	// defaults holds the default values of the operation's variables, which apply to those
+	// left out of variables.
+	defaults map[string]ast.Value
+}
+
+// measure returns the depth and complexity of the operation in doc named operationName, or
+// of its only operation when operationName is empty.
+func (c *graphqlCost) measure(doc *ast.Document, operationName string) (int, int) {
+	c.fragments = make(map[string]*ast.FragmentDefinition)
+
+	var operation *ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		switch definition := definition.(type) {
+		case *ast.FragmentDefinition:
+			c.fragments[definition.Name.Value] = definition
+		case *ast.OperationDefinition:
+			if operation == nil && (operationName == "" || definition.Name != nil && definition.Name.Value == operationName) {
+				operation = definition
+			}
+		}
+	}
+
+	if operation == nil {
+		return 0, 0
+	}
+
+	c.defaults = make(map[string]ast.Value)
+	for _, definition := range operation.VariableDefinitions {
+		if definition.DefaultValue != nil {
+			c.defaults[definition.Variable.Name.Value] = definition.DefaultValue
+		}
+	}
+
+	return c.selectionSet(operation.SelectionSet, 0, make(map[string]bool))
+}
+
+func (c *graphqlCost) selectionSet(set *ast.SelectionSet, level int, visiting map[string]bool) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, selection := range set.Selections {
+		var d, n int
+
+		switch selection := selection.(type) {
+		case *ast.Field:
+			name := selection.Name.Value
+			d, n = c.selectionSet(selection.SelectionSet, level+1, visiting)
+			if strings.HasPrefix(name, "__") {
+				if level+d+1 > c.introspectionDepth {
+					c.introspectionDepth = level + d + 1
+				}
+				complexity += n + 1
+				continue
+			}
+
+			if level == 0 && name == "movies" {
+				n *= c.pageSize(selection)
+			}
+			d, n = d+1, n+1
+		case *ast.InlineFragment:
+			d, n = c.selectionSet(selection.SelectionSet, level, visiting)
+		case *ast.FragmentSpread:
+			// Validation has already rejected fragment cycles, but the guard keeps a bad
+			// document from recursing forever.
+			name := selection.Name.Value
+			fragment, ok := c.fragments[name]
+			if !ok || visiting[name] {
+				continue
+			}
+			visiting[name] = true
+			d, n = c.selectionSet(fragment.SelectionSet, level, visiting)
+			delete(visiting, name)
+		}
+
+		if d > depth {
+			depth = d
+		}
+		complexity += n
+	}
+
+	return depth, complexity
+}
+
+// pageSize returns the number of movies a movies field can return, which is at most the
+// largest page size ValidateFilters accepts.
+func (c *graphqlCost) pageSize(field *ast.Field) int {
+	size := graphqlDefaultPageSize
+
+	for _, argument := range field.Arguments {
+		if argument.Name.Value != "pageSize" {
+			continue
+		}
+
+		value := argument.Value
+		if variable, ok := value.(*ast.Variable); ok {
+			if n, ok := c.variables[variable.Name.Value].(float64); ok {
+				size = int(n)
+			} else if _, ok := c.variables[variable.Name.Value]; !ok {
+				value = c.defaults[variable.Name.Value]
+			}
+		}
+		if value, ok := value.(*ast.IntValue); ok {
+			size, _ = strconv.Atoi(value.Value)
+		}
+	}
+
+	switch {
+	case size < 1:
+		return 1
+	case size > 100:
+		return 100
+	}
+	return size
+}
+
+// graphqlErrorResponse sends errors which stopped a GraphQL request before it ran.
+func (a *application) graphqlErrorResponse(w http.ResponseWriter, r *http.Request, errors []gqlerrors.FormattedError) {
+	err := a.writeJson(w, http.StatusBadRequest, envelop{"errors": errors}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphqlHandler runs a GraphQL query or mutation against the schema built by
+// graphqlSchema. Documents which don't parse, fail validation or exceed the depth or
+// complexity limits are rejected with a 400 response. Once the operation runs, the
+// response is always 200 OK, with any errors raised by resolvers listed next to the data,
+// as GraphQL clients expect.
+func (a *application) graphqlHandler(schema graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Query         string         `json:"query"`
+			OperationName string         `json:"operationName"`
+			Variables     map[string]any `json:"variables"`
+		}
+
+		err := a.readJSON(w, r, &input)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		v := validator.New()
+		if v.Check(input.Query != "", "query", "must be provided"); !v.Valid() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		doc, err := parser.Parse(parser.ParseParams{
+			Source: source.NewSource(&source.Source{Body: []byte(input.Query), Name: "GraphQL request"}),
+		})
+		if err != nil {
+			a.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(err))
+			return
+		}
+
+		validation := graphql.ValidateDocument(&schema, doc, nil)
+		if !validation.IsValid {
+			a.graphqlErrorResponse(w, r, validation.Errors)
+			return
+		}
+
+		cost := graphqlCost{variables: input.Variables}
+		depth, complexity := cost.measure(doc, input.OperationName)
+
+		var limitErr error
+		switch {
+		case depth > a.config.graphql.maxDepth:
+			limitErr = &graphqlError{code: "QUERY_TOO_DEEP", message: fmt.Sprintf("query depth %d exceeds the maximum of %d", depth, a.config.graphql.maxDepth)}
+		case cost.introspectionDepth > graphqlMaxIntrospectionDepth:
+			limitErr = &graphqlError{code: "QUERY_TOO_DEEP", message: fmt.Sprintf("introspection depth %d exceeds the maximum of %d", cost.introspectionDepth, graphqlMaxIntrospectionDepth)}
+		case complexity > a.config.graphql.maxComplexity:
+			limitErr = &graphqlError{code: "QUERY_TOO_COMPLEX", message: fmt.Sprintf("query complexity %d exceeds the maximum of %d", complexity, a.config.graphql.maxComplexity)}
+		}
+		if limitErr != nil {
+			a.graphqlErrorResponse(w, r, gqlerrors.FormatErrors(gqlerrors.NewLocatedError(limitErr, nil)))
+			return
+		}
+
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        schema,
+			Root:          map[string]any{"request": r},
+			AST:           doc,
+			OperationName: input.OperationName,
+			Args:          input.Variables,
+			Context:       r.Context(),
+		})
+
+		err = a.writeJson(w, http.StatusOK, result, nil)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// graphqlBody returns the body of a GraphQL request for query with the given variables.
+func graphqlBody(t *testing.T, query string, variables map[string]any) string {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGraphQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      string
+		query     string
+		variables map[string]any
+		status    int
+	}{
+		{
+			name:   "Movie",
+			user:   "activated",
+			query:  `{ movie(id: 1) { id title year runtime genres synopsis rating releaseDate originalLanguage version } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "MovieNotFound",
+			user:   "activated",
+			query:  `{ movie(id: 42) { title } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:      "Movies",
+			user:      "activated",
+			query:     `query List($genres: [String!], $size: Int) { movies(genres: $genres, sort: "-year", pageSize: $size) { movies { ...Summary } metadata { currentPage pageSize lastPage totalRecords } } } fragment Summary on Movie { title year }`,
+			variables: map[string]any{"genres": []string{"adventure"}, "size": 1},
+			status:    http.StatusOK,
+		},
+		{
+			name:   "MoviesFailedValidation",
+			user:   "activated",
+			query:  `{ movies(rating: "X", releasedAfter: "yesterday", page: 0, sort: "budget") { movies { title } } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "Me",
+			user:   "activated",
+			query:  `{ me { id name email activated createdAt } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "MeAnonymous",
+			query:  `{ me { name } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "Anonymous",
+			query:  `{ me { name } movie(id: 1) { title } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "Inactive",
+			user:   "inactive",
+			query:  `{ me { name activated } movies { movies { title } } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:      "CreateMovie",
+			user:      "activated",
+			query:     `mutation Create($input: MovieInput!) { createMovie(input: $input) { id title runtime genres releaseDate version } }`,
+			variables: map[string]any{"input": map[string]any{"title": "Up", "year": 2009, "runtime": 96, "genres": []string{"animation"}, "releaseDate": "2009-05-29"}},
+			status:    http.StatusOK,
+		},
+		{
+			name:   "CreateMovieFailedValidation",
+			user:   "activated",
+			query:  `mutation { createMovie(input: {title: "", year: 3000, genres: []}) { id } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "CreateMovieBadInput",
+			user:   "activated",
+			query:  `mutation { createMovie(input: {title: "Up", year: 2009, runtime: 96, genres: ["animation"], releaseDate: "May 29th"}) { id } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "UpdateMovie",
+			user:   "activated",
+			query:  `mutation { updateMovie(id: 3, input: {year: 1986, synopsis: ""}, expectedVersion: 1) { id title year synopsis version } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "UpdateMoviePreconditionFailed",
+			user:   "activated",
+			query:  `mutation { updateMovie(id: 3, input: {year: 1986}, expectedVersion: 2) { version } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "UpdateMovieNotFound",
+			user:   "activated",
+			query:  `mutation { updateMovie(id: 42, input: {year: 1986}) { version } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "DeleteMovie",
+			user:   "activated",
+			query:  `mutation { first: deleteMovie(id: 3, expectedVersion: 1) second: deleteMovie(id: 3) }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "RegisterUserDuplicateEmail",
+			query:  `mutation { registerUser(name: "Alice", email: "alice@example.com", password: "pa55word") { id } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "ActivateUserFailedValidation",
+			query:  `mutation { activateUser(token: "") { id } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "CreateAuthenticationTokenInvalidCredentials",
+			query:  `mutation { createAuthenticationToken(email: "alice@example.com", password: "wrong password") { token } }`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "SyntaxError",
+			user:   "activated",
+			query:  `{ movie(id: 1) { title }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "InvalidDocument",
+			user:   "activated",
+			query:  `{ movie(id: 1) { budget } }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "TooComplex",
+			user:   "activated",
+			query:  `{ movies(pageSize: 50) { movies { title year } } }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "TooComplexVariableDefault",
+			user:   "activated",
+			query:  `query ($size: Int = 50) { movies(pageSize: $size) { movies { title year } } }`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:      "VariableOverridesDefault",
+			user:      "activated",
+			query:     `query ($size: Int = 50) { movies(pageSize: $size) { movies { title year } } }`,
+			variables: map[string]any{"size": 2},
+			status:    http.StatusOK,
+		},
+		{
+			name:   "MissingQuery",
+			user:   "activated",
+			status: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			seedMovies(t, app)
+
+			tokens := map[string]string{
+				"activated": authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true)),
+				"inactive":  authToken(t, app, insertUser(t, app, "Bob", "bob@example.com", false)),
+			}
+
+			res := ts.do(t, http.MethodPost, "/v1/graphql", tokens[tt.user], graphqlBody(t, tt.query, tt.variables), nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.graphql.maxDepth = 2
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+	// Fragments don't add to the depth of the fields they select.
+	res := ts.do(t, http.MethodPost, "/v1/graphql", token, graphqlBody(t, `{ ...Me } fragment Me on Query { me { name } }`, nil), nil)
+	assertStatus(t, res, http.StatusOK)
+
+	res = ts.do(t, http.MethodPost, "/v1/graphql", token, graphqlBody(t, `{ movies { ... on MovieList { movies { title } } } }`, nil), nil)
+	assertStatus(t, res, http.StatusBadRequest)
+	assertGolden(t, res)
+}
+
+func TestGraphQLAccount(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	mailer := &mockMailer{}
+	app.mailer = mailer
+
+	res := ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, `mutation { registerUser(name: "Bob", email: "bob@example.com", password: "pa55word") { name email activated } }`, nil), nil)
+	assertStatus(t, res, http.StatusOK)
+	activationToken := mailer.messages()[0].data["activationToken"].(string)
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"UnknownToken", `mutation { activateUser(token: "AAAAAAAAAAAAAAAAAAAAAAAAAA") { activated } }`},
+		{"Activate", `mutation { activateUser(token: "` + activationToken + `") { name activated } }`},
+		{"AlreadyUsed", `mutation { activateUser(token: "` + activationToken + `") { activated } }`},
+		{"Authenticate", `mutation { createAuthenticationToken(email: "bob@example.com", password: "pa55word") { token expiry } }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, tt.query, nil), nil)
+
+			assertStatus(t, res, http.StatusOK)
+			assertGolden(t, res)
+		})
+	}
+
+	// The token returned by createAuthenticationToken authenticates later requests.
+	res = ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, `mutation { createAuthenticationToken(email: "bob@example.com", password: "pa55word") { token } }`, nil), nil)
+	var body struct {
+		Data struct {
+			CreateAuthenticationToken struct {
+				Token string `json:"token"`
+			} `json:"createAuthenticationToken"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(res.body, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	res = ts.do(t, http.MethodPost, "/v1/graphql", body.Data.CreateAuthenticationToken.Token, graphqlBody(t, `{ me { email activated } }`, nil), nil)
+	assertStatus(t, res, http.StatusOK)
+	assertGolden(t, res)
+}
+
+// graphqlIntrospectionQuery is the introspection query sent by GraphiQL.
+const graphqlIntrospectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+fragment FullType on __Type {
+  kind name description
+  fields(includeDeprecated: true) { name description args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue { name description type { ...TypeRef } defaultValue }
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}`
+
+func TestGraphQLIntrospection(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	// Introspection fields count towards the complexity, but not the depth of movie queries.
+	res := ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, graphqlIntrospectionQuery, nil), nil)
+	assertStatus(t, res, http.StatusBadRequest)
+	if !strings.Contains(string(res.body), "QUERY_TOO_COMPLEX") {
+		t.Errorf("got %s; want a QUERY_TOO_COMPLEX error", res.body)
+	}
+
+	app.config.graphql.maxComplexity = 2000
+	res = ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, graphqlIntrospectionQuery, nil), nil)
+	assertStatus(t, res, http.StatusOK)
+
+	// Nesting introspection fields deeper than any client needs is rejected.
+	query := `{ __type(name: "Movie") { fields { type { ` + strings.Repeat("ofType { ", 13) + "name" + strings.Repeat(" }", 16) + " }"
+	res = ts.do(t, http.MethodPost, "/v1/graphql", "", graphqlBody(t, query, nil), nil)
+	assertStatus(t, res, http.StatusBadRequest)
+	assertGolden(t, res)
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/greenlightpb"
+	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sort"
+	"strings"
+	"time"
+)
+
+// grpcAccess is the kind of user allowed to call a gRPC method.
+type grpcAccess int
+
+const (
+	grpcPublic grpcAccess = iota
+	grpcAuthenticated
+	grpcActivated
+)
+
+// grpcMethodAccess holds the access rules of the gRPC methods, matching those of the REST
+// endpoints. Methods which aren't listed require an activated user.
+var grpcMethodAccess = map[string]grpcAccess{
+	greenlightpb.AuthService_CreateAuthenticationToken_FullMethodName: grpcPublic,
+	greenlightpb.AuthService_GetCurrentUser_FullMethodName:            grpcAuthenticated,
+}
+
+// grpcMovieFields are the fields of MovieInput, as named in update masks.
+var grpcMovieFields = []string{"title", "year", "runtime", "genres", "synopsis", "rating", "release_date", "original_language"}
+
+// grpcServer returns the gRPC server for the MovieService and AuthService, which share the
+// application's models with the REST API.
+func (a *application) grpcServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(a.grpcRecoverPanic, a.grpcAuthenticate),
+		grpc.ChainStreamInterceptor(a.grpcRecoverPanicStream, a.grpcAuthenticateStream),
+	)
+
+	greenlightpb.RegisterMovieServiceServer(srv, &movieServer{app: a})
+	greenlightpb.RegisterAuthServiceServer(srv, &authServer{app: a})
+
+	return srv
+}
+
+func grpcContextSetUser(ctx context.Context, user *data.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+func grpcContextGetUser(ctx context.Context) *data.User {
+	user, ok := ctx.Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in call context")
+	}
+
+	return user
+}
+
+// grpcCheckAccess authenticates a call from the bearer token in its authorization
+// metadata, as authenticate does for HTTP requests, and checks that the user may call
+// method. It returns the call's context with the user added.
+func (a *application) grpcCheckAccess(ctx context.Context, method string) (context.Context, error) {
+	user := data.AnonymousUser
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		headerParts := strings.Split(values[0], " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			return nil, status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+		if data.ValidateTokenPlainText(v, token); !v.Valid() {
+			return nil, status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+		}
+
+		var err error
+		user, err = a.models.Users.GetForToken(ctx, data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+			default:
+				return nil, a.grpcServerError(ctx, err)
+			}
+		}
+	}
+
+	access, ok := grpcMethodAccess[method]
+	if !ok {
+		access = grpcActivated
+	}
+
+	switch {
+	case access >= grpcAuthenticated && user.IsAnonymous():
+		return nil, status.Error(codes.Unauthenticated, "you must be authenticated to access this resource")
+	case access >= grpcActivated && !user.Activated:
+		return nil, status.Error(codes.PermissionDenied, "your user account must be activated to access this resource")
+	}
+
+	return grpcContextSetUser(ctx, user), nil
+}
+
+func (a *application) grpcAuthenticate(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := a.grpcCheckAccess(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// grpcServerStream replaces the context of a stream with one carrying its user.
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *application) grpcAuthenticateStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.grpcCheckAccess(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &grpcServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// grpcRecoverPanic turns a panic in a gRPC method into an internal error, as recoverPanic
+// does for HTTP handlers, instead of letting it crash the server.
+func (a *application) grpcRecoverPanic(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = a.grpcServerError(ctx, fmt.Errorf("%s", p))
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+func (a *application) grpcRecoverPanicStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = a.grpcServerError(ss.Context(), fmt.Errorf("%s", p))
+		}
+	}()
+
+	return handler(srv, ss)
+}
+
+// grpcServerError logs an unexpected error and hides its details from the client, as
+// serverErrorResponse does.
+func (a *application) grpcServerError(ctx context.Context, err error) error {
+	method, _ := grpc.Method(ctx)
+
+	switch {
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		return status.Error(codes.Canceled, "the call was cancelled by the client")
+	case errors.Is(err, context.DeadlineExceeded):
+		a.logger.Component("grpc").PrintError(err, map[string]any{"grpc_method": method})
+		return status.Error(codes.DeadlineExceeded, "the server timed out while processing your request, please try again")
+	}
+
+	a.logger.Component("grpc").PrintError(err, map[string]any{"grpc_method": method})
+	return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+}
+
+// grpcValidationError returns an InvalidArgument error listing the failed validations as
+// field violations, using the same keys and messages as the REST endpoints.
+func grpcValidationError(errors map[string]string) error {
+	fields := make([]string, 0, len(errors))
+	for field := range errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	details := &errdetails.BadRequest{}
+	for _, field := range fields {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: errors[field],
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, "the input failed validation").WithDetails(details)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "the input failed validation")
+	}
+	return st.Err()
+}
+
+func grpcNotFoundError() error {
+	return status.Error(codes.NotFound, "the requested resource could not be found")
+}
+
+func grpcPreconditionFailedError() error {
+	return status.Error(codes.FailedPrecondition, "the record has been modified since you last fetched it, fetch the latest version and try again")
+}
+
+func movieToProto(movie *data.Movie) *greenlightpb.Movie {
+	return &greenlightpb.Movie{
+		Id:               movie.ID,
+		Title:            movie.Title,
+		Year:             movie.Year,
+		Runtime:          int32(movie.RunTime),
+		Genres:           movie.Genres,
+		Synopsis:         movie.Synopsis,
+		Rating:           movie.Rating,
+		ReleaseDate:      movie.ReleaseDate.String(),
+		OriginalLanguage: movie.OriginalLanguage,
+		Version:          movie.Version,
+	}
+}
+
+// grpcDate parses a date field of a request, reporting errors under key as readDate does.
+// An empty string is the zero date.
+func grpcDate(v *validator.Validator, key, s string) data.Date {
+	if s == "" {
+		return data.Date{}
+	}
+	d, err := data.ParseDate(s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+		return data.Date{}
+	}
+
+	return d
+}
+
+// applyMovieInput copies the fields of src named by paths into input.
+func applyMovieInput(v *validator.Validator, input *movieInput, src *greenlightpb.MovieInput, paths []string) {
+	for _, path := range paths {
+		switch path {
+		case "title":
+			input.Title = src.GetTitle()
+		case "year":
+			input.Year = src.GetYear()
+		case "runtime":
+			input.RunTime = data.Runtime(src.GetRuntime())
+		case "genres":
+			input.Genres = src.GetGenres()
+		case "synopsis":
+			input.Synopsis = src.GetSynopsis()
+		case "rating":
+			input.Rating = src.GetRating()
+		case "release_date":
+			input.ReleaseDate = grpcDate(v, "release_date", src.GetReleaseDate())
+		case "original_language":
+			input.OriginalLanguage = src.GetOriginalLanguage()
+		default:
+			v.AddError("update_mask", fmt.Sprintf("unknown field %q", path))
+		}
+	}
+}
+
+// grpcExpectedVersion checks the expected version of an update or delete against movie, as
+// the X-Expected-Version header does. An expected version of 0 isn't checked.
+func grpcExpectedVersion(expected int32, movie *data.Movie) error {
+	switch {
+	case expected < 0:
+		return grpcValidationError(map[string]string{"expected_version": "must be a positive integer"})
+	case expected > 0 && expected != movie.Version:
+		return grpcPreconditionFailedError()
+	}
+	return nil
+}
+
+// movieServer implements the MovieService, mirroring the movie handlers.
+type movieServer struct {
+	greenlightpb.UnimplementedMovieServiceServer
+	app *application
+}
+
+func (s *movieServer) GetMovie(ctx context.Context, req *greenlightpb.GetMovieRequest) (*greenlightpb.Movie, error) {
+	if req.GetId() < 1 {
+		return nil, grpcNotFoundError()
+	}
+
+	movie, err := s.app.models.Movies.Get(ctx, req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, grpcNotFoundError()
+		default:
+			return nil, s.app.grpcServerError(ctx, err)
+		}
+	}
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) ListMovies(ctx context.Context, req *greenlightpb.ListMoviesRequest) (*greenlightpb.ListMoviesResponse, error) {
+	var input movieListInput
+	v := validator.New()
+
+	input.Title = req.GetTitle()
+	input.Genres = req.GetGenres()
+	if input.Genres == nil {
+		input.Genres = []string{}
+	}
+	input.Rating = req.GetRating()
+
+	input.ReleasedAfter = grpcDate(v, "released_after", req.GetReleasedAfter())
+	input.ReleasedBefore = grpcDate(v, "released_before", req.GetReleasedBefore())
+
+	input.Filters.Page = int(req.GetPage())
+	if input.Filters.Page == 0 {
+		input.Filters.Page = 1
+	}
+	input.Filters.PageSize = int(req.GetPageSize())
+	if input.Filters.PageSize == 0 {
+		input.Filters.PageSize = 20
+	}
+	input.Filters.Sort = req.GetSort()
+	if input.Filters.Sort == "" {
+		input.Filters.Sort = "id"
+	}
+	input.Filters.SortSafeList = movieSortSafeList
+
+	if validateMovieListInput(v, &input); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	movies, metadata, err := s.app.models.Movies.GetAll(ctx, input.Title, input.Genres, input.Rating, input.ReleasedAfter, input.ReleasedBefore, input.Filters)
+	if err != nil {
+		return nil, s.app.grpcServerError(ctx, err)
+	}
+
+	res := &greenlightpb.ListMoviesResponse{
+		Movies: make([]*greenlightpb.Movie, 0, len(movies)),
+		Metadata: &greenlightpb.Metadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+	}
+	for _, movie := range movies {
+		res.Movies = append(res.Movies, movieToProto(movie))
+	}
+
+	return res, nil
+}
+
+func (s *movieServer) CreateMovie(ctx context.Context, req *greenlightpb.CreateMovieRequest) (*greenlightpb.Movie, error) {
+	var input movieInput
+	v := validator.New()
+
+	applyMovieInput(v, &input, req.GetMovie(), grpcMovieFields)
+	if !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	movie := &data.Movie{}
+	input.copyTo(movie)
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	err := s.app.models.Movies.Insert(ctx, movie)
+	if err != nil {
+		return nil, s.app.grpcServerError(ctx, err)
+	}
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) UpdateMovie(ctx context.Context, req *greenlightpb.UpdateMovieRequest) (*greenlightpb.Movie, error) {
+	if req.GetId() < 1 {
+		return nil, grpcNotFoundError()
+	}
+
+	// Read the movie from the primary, as updateMovieHandler does.
+	movie, err := s.app.models.Movies.Get(data.WithPrimary(ctx), req.GetId())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, grpcNotFoundError()
+		default:
+			return nil, s.app.grpcServerError(ctx, err)
+		}
+	}
+
+	err = grpcExpectedVersion(req.GetExpectedVersion(), movie)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = grpcMovieFields
+	}
+
+	input := newMovieInput(movie)
+	v := validator.New()
+
+	applyMovieInput(v, &input, req.GetMovie(), paths)
+	if !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+	input.copyTo(movie)
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	err = s.app.models.Movies.Update(ctx, movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && req.GetExpectedVersion() != 0:
+			return nil, grpcPreconditionFailedError()
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+		default:
+			return nil, s.app.grpcServerError(ctx, err)
+		}
+	}
+
+	return movieToProto(movie), nil
+}
+
+func (s *movieServer) DeleteMovie(ctx context.Context, req *greenlightpb.DeleteMovieRequest) (*greenlightpb.DeleteMovieResponse, error) {
+	if req.GetId() < 1 {
+		return nil, grpcNotFoundError()
+	}
+
+	// As with DELETE requests, only a conditional delete loads the movie first.
+	var version int32
+	if req.GetExpectedVersion() != 0 {
+		movie, err := s.app.models.Movies.Get(data.WithPrimary(ctx), req.GetId())
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, grpcNotFoundError()
+			default:
+				return nil, s.app.grpcServerError(ctx, err)
+			}
+		}
+
+		err = grpcExpectedVersion(req.GetExpectedVersion(), movie)
+		if err != nil {
+			return nil, err
+		}
+		version = movie.Version
+	}
+
+	err := s.app.models.Movies.Delete(ctx, req.GetId(), version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, grpcNotFoundError()
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, grpcPreconditionFailedError()
+		default:
+			return nil, s.app.grpcServerError(ctx, err)
+		}
+	}
+
+	return &greenlightpb.DeleteMovieResponse{}, nil
+}
+
+// authServer implements the AuthService.
+type authServer struct {
+	greenlightpb.UnimplementedAuthServiceServer
+	app *application
+}
+
+func (s *authServer) CreateAuthenticationToken(ctx context.Context, req *greenlightpb.CreateAuthenticationTokenRequest) (*greenlightpb.AuthenticationToken, error) {
+	v := validator.New()
+
+	data.ValidateEmail(v, req.GetEmail())
+	data.ValidatePasswordPlaintext(v, req.GetPassword())
+	if !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	user, err := s.app.models.Users.GetByEmail(ctx, req.GetEmail())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+		default:
+			return nil, s.app.grpcServerError(ctx, err)
+		}
+	}
+
+	match, err := user.Password.Matches(ctx, req.GetPassword())
+	if err != nil {
+		return nil, s.app.grpcServerError(ctx, err)
+	}
+
+	if !match {
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	token, err := s.app.models.Tokens.New(ctx, user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return nil, s.app.grpcServerError(ctx, err)
+	}
+
+	return &greenlightpb.AuthenticationToken{
+		Token:  token.Plaintext,
+		Expiry: timestamppb.New(token.Expiry),
+	}, nil
+}
+
+func (s *authServer) GetCurrentUser(ctx context.Context, req *greenlightpb.GetCurrentUserRequest) (*greenlightpb.User, error) {
+	user := grpcContextGetUser(ctx)
+
+	return &greenlightpb.User{
+		Id:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		Activated: user.Activated,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+	}, nil
+}
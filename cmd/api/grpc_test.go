@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/greenlightpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// newTestGRPCConn serves the application's gRPC services over an in-memory connection and
+// returns a client connection to them.
+func newTestGRPCConn(t *testing.T, app *application) *grpc.ClientConn {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := app.grpcServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// withToken returns a context which sends token as the bearer token of a call.
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func assertCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+
+	if got := status.Code(err); got != want {
+		t.Errorf("got code %s; want %s; error: %v", got, want, err)
+	}
+}
+
+// fieldViolations returns the field violations in the details of a status error.
+func fieldViolations(t *testing.T, err error) map[string]string {
+	t.Helper()
+
+	violations := make(map[string]string)
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				violations[violation.GetField()] = violation.GetDescription()
+			}
+		}
+	}
+	return violations
+}
+
+func TestGRPCAuthService(t *testing.T) {
+	app := newTestApplication(t)
+	client := greenlightpb.NewAuthServiceClient(newTestGRPCConn(t, app))
+	insertUser(t, app, "Alice", "alice@example.com", true)
+
+	t.Run("CreateAuthenticationToken", func(t *testing.T) {
+		token, err := client.CreateAuthenticationToken(context.Background(), &greenlightpb.CreateAuthenticationTokenRequest{Email: "alice@example.com", Password: "pa55word"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user, err := client.GetCurrentUser(withToken(token.GetToken()), &greenlightpb.GetCurrentUserRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.GetEmail() != "alice@example.com" || !user.GetActivated() {
+			t.Errorf("got user %v; want alice@example.com, activated", user)
+		}
+	})
+
+	t.Run("InvalidCredentials", func(t *testing.T) {
+		_, err := client.CreateAuthenticationToken(context.Background(), &greenlightpb.CreateAuthenticationTokenRequest{Email: "alice@example.com", Password: "wrong-password"})
+		assertCode(t, err, codes.Unauthenticated)
+	})
+
+	t.Run("FailedValidation", func(t *testing.T) {
+		_, err := client.CreateAuthenticationToken(context.Background(), &greenlightpb.CreateAuthenticationTokenRequest{Email: "alice"})
+		assertCode(t, err, codes.InvalidArgument)
+
+		want := map[string]string{"email": "must be a valid email address", "password": "must be provided"}
+		if got := fieldViolations(t, err); !reflect.DeepEqual(got, want) {
+			t.Errorf("got field violations %v; want %v", got, want)
+		}
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		_, err := client.GetCurrentUser(context.Background(), &greenlightpb.GetCurrentUserRequest{})
+		assertCode(t, err, codes.Unauthenticated)
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		_, err := client.GetCurrentUser(withToken("ABCDEFGHIJKLMNOPQRSTUVWXYZ"), &greenlightpb.GetCurrentUserRequest{})
+		assertCode(t, err, codes.Unauthenticated)
+	})
+}
+
+func TestGRPCMovieService(t *testing.T) {
+	app := newTestApplication(t)
+	client := greenlightpb.NewMovieServiceClient(newTestGRPCConn(t, app))
+	seedMovies(t, app)
+
+	ctx := withToken(authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true)))
+
+	t.Run("PermissionDenied", func(t *testing.T) {
+		_, err := client.GetMovie(context.Background(), &greenlightpb.GetMovieRequest{Id: 1})
+		assertCode(t, err, codes.Unauthenticated)
+
+		inactive := withToken(authToken(t, app, insertUser(t, app, "Bob", "bob@example.com", false)))
+		_, err = client.GetMovie(inactive, &greenlightpb.GetMovieRequest{Id: 1})
+		assertCode(t, err, codes.PermissionDenied)
+	})
+
+	t.Run("GetMovie", func(t *testing.T) {
+		movie, err := client.GetMovie(ctx, &greenlightpb.GetMovieRequest{Id: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if movie.GetTitle() != "Moana" || movie.GetRuntime() != 107 || movie.GetReleaseDate() != "2016-11-23" {
+			t.Errorf("got movie %v; want Moana", movie)
+		}
+
+		_, err = client.GetMovie(ctx, &greenlightpb.GetMovieRequest{Id: 42})
+		assertCode(t, err, codes.NotFound)
+	})
+
+	t.Run("ListMovies", func(t *testing.T) {
+		res, err := client.ListMovies(ctx, &greenlightpb.ListMoviesRequest{Genres: []string{"adventure"}, Sort: "-year", PageSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetMovies()) != 1 || res.GetMovies()[0].GetTitle() != "Black Panther" {
+			t.Errorf("got movies %v; want Black Panther", res.GetMovies())
+		}
+		if res.GetMetadata().GetTotalRecords() != 2 || res.GetMetadata().GetLastPage() != 2 {
+			t.Errorf("got metadata %v; want 2 records over 2 pages", res.GetMetadata())
+		}
+
+		_, err = client.ListMovies(ctx, &greenlightpb.ListMoviesRequest{ReleasedAfter: "yesterday", Sort: "budget"})
+		assertCode(t, err, codes.InvalidArgument)
+
+		want := map[string]string{"released_after": "must be a date in YYYY-MM-DD format", "sort": "invalid sort value"}
+		if got := fieldViolations(t, err); !reflect.DeepEqual(got, want) {
+			t.Errorf("got field violations %v; want %v", got, want)
+		}
+	})
+
+	t.Run("CreateMovie", func(t *testing.T) {
+		movie, err := client.CreateMovie(ctx, &greenlightpb.CreateMovieRequest{Movie: &greenlightpb.MovieInput{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if movie.GetId() != 4 || movie.GetVersion() != 1 {
+			t.Errorf("got movie %v; want ID 4 at version 1", movie)
+		}
+
+		_, err = client.CreateMovie(ctx, &greenlightpb.CreateMovieRequest{Movie: &greenlightpb.MovieInput{Title: "Up", Year: 2009, Runtime: -1}})
+		assertCode(t, err, codes.InvalidArgument)
+
+		want := map[string]string{"genres": "must be provided", "runtime": "must be a positive integer"}
+		if got := fieldViolations(t, err); !reflect.DeepEqual(got, want) {
+			t.Errorf("got field violations %v; want %v", got, want)
+		}
+	})
+
+	t.Run("UpdateMovie", func(t *testing.T) {
+		movie, err := client.UpdateMovie(ctx, &greenlightpb.UpdateMovieRequest{
+			Id:              3,
+			Movie:           &greenlightpb.MovieInput{Year: 1986},
+			UpdateMask:      &fieldmaskpb.FieldMask{Paths: []string{"year", "synopsis"}},
+			ExpectedVersion: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if movie.GetYear() != 1986 || movie.GetSynopsis() != "" || movie.GetTitle() != "The Breakfast Club" || movie.GetVersion() != 2 {
+			t.Errorf("got movie %v; want only the year and synopsis updated", movie)
+		}
+
+		_, err = client.UpdateMovie(ctx, &greenlightpb.UpdateMovieRequest{Id: 3, Movie: &greenlightpb.MovieInput{Year: 1987}, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"year"}}, ExpectedVersion: 1})
+		assertCode(t, err, codes.FailedPrecondition)
+
+		_, err = client.UpdateMovie(ctx, &greenlightpb.UpdateMovieRequest{Id: 3, UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"budget"}}})
+		assertCode(t, err, codes.InvalidArgument)
+
+		_, err = client.UpdateMovie(ctx, &greenlightpb.UpdateMovieRequest{Id: 42, Movie: &greenlightpb.MovieInput{Year: 1987}})
+		assertCode(t, err, codes.NotFound)
+	})
+
+	t.Run("DeleteMovie", func(t *testing.T) {
+		_, err := client.DeleteMovie(ctx, &greenlightpb.DeleteMovieRequest{Id: 2, ExpectedVersion: 7})
+		assertCode(t, err, codes.FailedPrecondition)
+
+		_, err = client.DeleteMovie(ctx, &greenlightpb.DeleteMovieRequest{Id: 2, ExpectedVersion: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.DeleteMovie(ctx, &greenlightpb.DeleteMovieRequest{Id: 2})
+		assertCode(t, err, codes.NotFound)
+	})
+}
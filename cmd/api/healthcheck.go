@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func (a *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,3 +25,145 @@ func (a *application) healthcheckHandler(w http.ResponseWriter, r *http.Request)
 		a.serverErrorResponse(w, r, err)
 	}
 }
+
+// healthCheckTimeout bounds every readiness check, so a dependency which hangs fails its
+// check instead of holding up the probe.
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck is a component the API can't serve requests without. check returns details
+// worth reporting, such as a version, along with an error when the component is unusable.
+// As the endpoints are public, the error is only logged, as a warning, and failure is
+// reported instead.
+type healthCheck struct {
+	name    string
+	failure string
+	check   func(ctx context.Context) (map[string]any, error)
+}
+
+// readinessChecks returns the checks of the components configured. The database is only
+// checked with -storage=database, and the SMTP server with -healthz-check-smtp.
+func (a *application) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "shutdown", failure: "shutdown has begun", check: a.checkShutdown},
+	}
+
+	if a.db != nil {
+		checks = append(checks,
+			healthCheck{name: "database", failure: "the database can't be reached", check: a.checkDatabase},
+			healthCheck{name: "migrations", failure: "the database schema isn't up to date", check: a.checkMigrations},
+		)
+	}
+	if a.config.healthz.checkSMTP {
+		checks = append(checks, healthCheck{name: "smtp", failure: "the SMTP server can't be reached", check: a.checkSMTP})
+	}
+
+	return checks
+}
+
+func (a *application) checkShutdown(ctx context.Context) (map[string]any, error) {
+	if a.shuttingDown.Load() {
+		return nil, errors.New("shutdown has begun")
+	}
+	return nil, nil
+}
+
+func (a *application) checkDatabase(ctx context.Context) (map[string]any, error) {
+	return nil, a.db.PingContext(ctx)
+}
+
+// checkMigrations compares the version recorded by golang-migrate with the newest migration
+// embedded in the binary, in case the schema was changed since the application started.
+func (a *application) checkMigrations(ctx context.Context) (map[string]any, error) {
+	latest := a.latestSchemaVersion
+
+	var (
+		current int64
+		dirty   bool
+	)
+	err := a.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&current, &dirty)
+	if err != nil {
+		return map[string]any{"latest": latest}, err
+	}
+
+	details := map[string]any{"version": current, "latest": latest}
+	switch {
+	case dirty:
+		return details, fmt.Errorf("database schema version %d is dirty", current)
+	case current < int64(latest):
+		return details, fmt.Errorf("database schema version %d is behind the latest migration %d", current, latest)
+	}
+	return details, nil
+}
+
+func (a *application) checkSMTP(ctx context.Context) (map[string]any, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.config.smtp.host, strconv.Itoa(a.config.smtp.port)))
+	if err != nil {
+		return nil, err
+	}
+	return nil, conn.Close()
+}
+
+// livenessHandler tells an orchestrator the process is able to serve requests at all. It
+// checks no dependencies, so an outage of one doesn't get every instance restarted.
+func (a *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.writeJson(w, http.StatusOK, envelop{"status": "alive"}, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// readinessHandler runs every readiness check at once, and responds with the status and
+// latency of each component, with 503 Service Unavailable if any of them failed so load
+// balancers stop sending requests to this instance.
+func (a *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := a.readinessChecks()
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		ready      = true
+		components = make(map[string]map[string]any, len(checks))
+	)
+
+	for _, hc := range checks {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			details, err := hc.check(ctx)
+			component := map[string]any{
+				"status":     "up",
+				"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			}
+			for key, value := range details {
+				component[key] = value
+			}
+			if err != nil {
+				component["status"] = "down"
+				component["error"] = hc.failure
+				a.loggerFor(r).Component("healthz").PrintWarn(err.Error(), map[string]any{"check": hc.name})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			components[hc.name] = component
+			ready = ready && err == nil
+		}(hc)
+	}
+	wg.Wait()
+
+	status, env := http.StatusOK, envelop{"status": "ready", "components": components}
+	if !ready {
+		status, env["status"] = http.StatusServiceUnavailable, "unavailable"
+	}
+
+	err := a.writeJson(w, status, env, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+
+	res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", nil)
+
+	assertStatus(t, res, http.StatusOK)
+	assertGolden(t, res)
+}
+
+func TestLiveness(t *testing.T) {
+	app := newTestApplication(t)
+	app.shuttingDown.Store(true)
+	ts := newTestServer(t, app)
+
+	// The process is alive until it exits, even while shutting down.
+	res := ts.do(t, http.MethodGet, "/v1/healthz/live", "", "", nil)
+
+	assertStatus(t, res, http.StatusOK)
+	assertGolden(t, res)
+}
+
+// openSchemaDB returns a SQLite database whose schema golang-migrate recorded as version.
+func openSchemaDB(t *testing.T, version int64, dirty bool) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "greenlight.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("CREATE TABLE schema_migrations (version uint64, dirty bool)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_migrations (version, dirty) VALUES (?, ?)", version, dirty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestReadiness(t *testing.T) {
+	latest, err := latestMigration("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens on this port once the listener is closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T, app *application)
+		status int
+	}{
+		{
+			name:   "MemoryStorage",
+			setup:  func(t *testing.T, app *application) {},
+			status: http.StatusOK,
+		},
+		{
+			name: "Database",
+			setup: func(t *testing.T, app *application) {
+				app.db = openSchemaDB(t, int64(latest), false)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "DatabaseClosed",
+			setup: func(t *testing.T, app *application) {
+				app.db = openSchemaDB(t, int64(latest), false)
+				app.db.Close()
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "SchemaBehind",
+			setup: func(t *testing.T, app *application) {
+				app.db = openSchemaDB(t, int64(latest)-1, false)
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "SchemaDirty",
+			setup: func(t *testing.T, app *application) {
+				app.db = openSchemaDB(t, int64(latest), true)
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "SMTPUnreachable",
+			setup: func(t *testing.T, app *application) {
+				app.config.healthz.checkSMTP = true
+				app.config.smtp.host = "127.0.0.1"
+				app.config.smtp.port = closedPort
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "ShuttingDown",
+			setup: func(t *testing.T, app *application) {
+				app.shuttingDown.Store(true)
+			},
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.db.dsn = "sqlite://greenlight.db"
+			app.latestSchemaVersion = latest
+			tt.setup(t, app)
+			ts := newTestServer(t, app)
+
+			res := ts.do(t, http.MethodGet, "/v1/healthz/ready", "", "", nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+}
+
+func TestReadinessNotRateLimited(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 1
+	ts := newTestServer(t, app)
+
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/v1/healthz/live", "/v1/healthz/ready"} {
+			res := ts.do(t, http.MethodGet, path, "", "", nil)
+			assertStatus(t, res, http.StatusOK)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
 	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -31,21 +37,121 @@ func (a *application) writeJson(w http.ResponseWriter, status int, data any, hea
 	}
 
 	j = append(j, '\n')
+	w.Header().Set("Content-Type", "application/json")
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(j)
 	return nil
 }
 
+// writeJSONWithETag sends a 200 OK JSON response tagged with a strong etag, or an empty 304
+// Not Modified response when the request's If-None-Match header already matches it. An
+// empty etag is derived from a hash of the response body.
+func (a *application) writeJSONWithETag(w http.ResponseWriter, r *http.Request, data any, etag string) error {
+	j, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	j = append(j, '\n')
+	if etag == "" {
+		sum := sha256.Sum256(j)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Values("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	return nil
+}
+
+// movieETag returns the strong ETag of a movie's representation, which changes whenever its
+// version does.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d"`, movie.ID, movie.Version)
+}
+
+// etagMatches reports whether etag is in the list of entity tags from an If-None-Match or
+// If-Match header. RFC 9110 requires the weak comparison for If-None-Match, which ignores
+// the W/ prefix, and the strong comparison for If-Match, where weak tags never match.
+func etagMatches(headers []string, etag string, weak bool) bool {
+	for _, header := range headers {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if weak {
+				tag = strings.TrimPrefix(tag, "W/")
+			}
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// checkMoviePreconditions evaluates the If-Match and X-Expected-Version headers against the
+// current movie, returning errPreconditionFailed if either of them doesn't match. It
+// reports whether the request sent either header, in which case a later edit conflict also
+// means the precondition failed.
+func checkMoviePreconditions(r *http.Request, movie *data.Movie) (bool, error) {
+	ifMatch := r.Header.Values("If-Match")
+	expectedVersion := r.Header.Get("X-Expected-Version")
+
+	if expectedVersion != "" {
+		version, err := strconv.ParseInt(expectedVersion, 10, 32)
+		if err != nil || version < 1 {
+			return true, errors.New("X-Expected-Version header must be a positive integer")
+		}
+		if int32(version) != movie.Version {
+			return true, errPreconditionFailed
+		}
+	}
+
+	if len(ifMatch) > 0 && !etagMatches(ifMatch, movieETag(movie), false) {
+		return true, errPreconditionFailed
+	}
+
+	return len(ifMatch) > 0 || expectedVersion != "", nil
+}
+
 func (a *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	// Decode the request into the target destination
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-	dec := json.NewDecoder(r.Body)
+	return decodeJSON(r.Body, dst)
+}
+
+// readBody reads the whole request body, up to the same limit as readJSON, and replaces it
+// with a copy which the handler can still decode.
+func (a *application) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return nil, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		}
+		return nil, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// decodeJSON decodes a single JSON value from body into dst, turning decoding errors into
+// messages which can be shown to the client.
+func decodeJSON(body io.Reader, dst any) error {
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields() // remove unwanted fields
 
 	err := dec.Decode(dst)
@@ -116,6 +222,79 @@ func (a *application) readJSON(w http.ResponseWriter, r *http.Request, dst any)
 	return nil
 }
 
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	jsonPatchMediaType  = "application/json-patch+json"
+)
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errPatchNotApplicable   = errors.New("the patch could not be applied")
+)
+
+// readPatch reads a PATCH request body, returning it along with its media type. Requests
+// sent as plain application/json, or without a Content-Type, are treated as JSON Merge
+// Patch documents, which is how partial updates were sent before either format was
+// supported.
+func (a *application) readPatch(w http.ResponseWriter, r *http.Request) (string, json.RawMessage, error) {
+	mediaType := mergePatchMediaType
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", nil, errUnsupportedMediaType
+		}
+
+		switch parsed {
+		case mergePatchMediaType, "application/json":
+		case jsonPatchMediaType:
+			mediaType = jsonPatchMediaType
+		default:
+			return "", nil, errUnsupportedMediaType
+		}
+	}
+
+	var patch json.RawMessage
+	err := a.readJSON(w, r, &patch)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return mediaType, patch, nil
+}
+
+// applyPatch applies an RFC 7396 JSON Merge Patch or RFC 6902 JSON Patch document to the
+// JSON encoding of doc, and decodes the result into dst. A JSON Patch whose operations don't
+// apply to doc, such as a failed test, returns an error wrapping errPatchNotApplicable.
+func applyPatch(doc any, mediaType string, patch []byte, dst any) error {
+	original, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	var patched []byte
+
+	switch mediaType {
+	case jsonPatchMediaType:
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return fmt.Errorf("body contains an invalid JSON Patch document: %s", err)
+		}
+
+		patched, err = operations.Apply(original)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errPatchNotApplicable, err)
+		}
+	default:
+		patched, err = jsonpatch.MergePatch(original, patch)
+		if err != nil {
+			return fmt.Errorf("body contains an invalid JSON Merge Patch document: %s", err)
+		}
+	}
+
+	return decodeJSON(bytes.NewReader(patched), dst)
+}
+
 func (a *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -148,10 +327,26 @@ func (a *application) readInt(qs url.Values, key string, defaultValue int, v *va
 	return i
 }
 
+func (a *application) readDate(qs url.Values, key string, v *validator.Validator) data.Date {
+	s := qs.Get(key)
+	if s == "" {
+		return data.Date{}
+	}
+	d, err := data.ParseDate(s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+		return data.Date{}
+	}
+
+	return d
+}
+
 func (a *application) background(fn func()) {
 	a.wg.Add(1)
+	a.metrics.backgroundTasks.Inc()
 	go func() {
 		defer a.wg.Done()
+		defer a.metrics.backgroundTasks.Dec()
 		defer func() {
 			if err := recover(); err != nil {
 				a.logger.PrintError(fmt.Errorf("%s", err), nil)
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/tomasen/realip"
+	"net/http"
+	"time"
+)
+
+// idempotencyLockTimeout is how long a key stays reserved by a request which is still in
+// progress. It outlasts the server's write timeout, so it only runs out for requests which
+// never finished, such as those of a server which crashed.
+const idempotencyLockTimeout = time.Minute
+
+// idempotencyPurgeTimeout bounds each purge of the expired idempotency keys.
+const idempotencyPurgeTimeout = time.Minute
+
+// idempotencyHeaders are the response headers recorded along with the status and body.
+var idempotencyHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotencyRecorder passes a response through to the client while recording it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *idempotencyRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients safely retry a POST request by sending it with an Idempotency-Key
+// header. The first response for a key is recorded, and later requests with the same key
+// from the same user get that response replayed instead of running the handler again.
+// Reusing a key for a different request is rejected, as is sending a request while another
+// one with the same key is still in progress. Responses with a 5xx status aren't recorded,
+// so that the request can be retried.
+//
+// It must run after authenticate, as keys are scoped to the user. Anonymous users have no ID
+// to scope keys to, so their keys are scoped to their IP address instead, and clients
+// should use random keys such as UUIDs.
+func (a *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			a.badRequestResponse(w, r, errors.New("Idempotency-Key header must not be more than 255 bytes long"))
+			return
+		}
+
+		// Read the whole body to hash it, leaving the handler a copy to decode.
+		body, err := a.readBody(w, r)
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+		hash.Write(body)
+
+		user := a.contextGetUser(r)
+		if user.IsAnonymous() {
+			key = realip.FromRequest(r) + " " + key
+		}
+
+		record := &data.IdempotencyKey{
+			Key:         key,
+			UserID:      user.ID,
+			RequestHash: hash.Sum(nil),
+			Expiry:      time.Now().Add(idempotencyLockTimeout),
+		}
+
+		existing, err := a.modelsFor(r).IdempotencyKeys.Reserve(r.Context(), record)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				a.idempotencyKeyInUseResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case !bytes.Equal(existing.RequestHash, record.RequestHash):
+				a.idempotencyKeyMismatchResponse(w, r)
+			case existing.Status == 0:
+				a.idempotencyKeyInUseResponse(w, r)
+			default:
+				for name, value := range existing.Header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rw := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+
+		// The request's context may already be cancelled once the handler returns, so the
+		// key is released or completed with a fresh one. A handler which panicked or failed
+		// has its reservation released straight away.
+		defer func() {
+			if completed {
+				return
+			}
+			err := a.modelsFor(r).IdempotencyKeys.Release(context.Background(), record.UserID, record.Key)
+			if err != nil {
+				a.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+
+		if rw.status == 0 || rw.status >= http.StatusInternalServerError {
+			return
+		}
+		completed = true
+
+		record.Status = rw.status
+		record.Body = rw.body.Bytes()
+		record.Expiry = time.Now().Add(a.config.idempotency.ttl)
+		record.Header = make(map[string]string)
+		for _, name := range idempotencyHeaders {
+			if value := w.Header().Get(name); value != "" {
+				record.Header[name] = value
+			}
+		}
+
+		// If the response can't be recorded, the key stays reserved until its lock times
+		// out rather than being released, as retrying would repeat the request.
+		err = a.modelsFor(r).IdempotencyKeys.Complete(context.Background(), record)
+		if err != nil {
+			a.logError(r, err)
+		}
+	}
+}
+
+// purgeIdempotencyKeys deletes expired idempotency keys once every interval, until ctx is
+// cancelled. Expired keys are already ignored, so this only keeps the table from growing.
+func (a *application) purgeIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	logger := a.logger.Component("idempotency")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purgeCtx, cancel := context.WithTimeout(ctx, idempotencyPurgeTimeout)
+		err := a.models.IdempotencyKeys.DeleteExpired(purgeCtx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			logger.PrintError(err, nil)
+		default:
+			logger.PrintDebug("expired idempotency keys purged", nil)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingMovies fails every insert, as if the database were unavailable.
+type failingMovies struct {
+	data.MovieStore
+}
+
+func (failingMovies) Insert(ctx context.Context, movie *data.Movie) error {
+	return errors.New("database unavailable")
+}
+
+func TestIdempotentCreateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	alice := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	bob := authToken(t, app, insertUser(t, app, "Bob", "bob@example.com", true))
+
+	body := `{"title": "Moana", "year": 2016, "run_time": "107 mins", "genres": ["animation"]}`
+	key := map[string]string{"Idempotency-Key": "0b6c3a5e-movie"}
+
+	first := ts.do(t, http.MethodPost, "/v1/movies", alice, body, key)
+	assertStatus(t, first, http.StatusCreated)
+
+	retry := ts.do(t, http.MethodPost, "/v1/movies", alice, body, key)
+	assertStatus(t, retry, http.StatusCreated)
+	if !bytes.Equal(retry.body, first.body) {
+		t.Errorf("got replayed body %s; want %s", retry.body, first.body)
+	}
+	if got := retry.header.Get("Location"); got != "/v1/movies/1" {
+		t.Errorf("got replayed Location %q; want %q", got, "/v1/movies/1")
+	}
+	if got := retry.header.Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("got Idempotent-Replayed %q; want %q", got, "true")
+	}
+
+	// Keys are scoped to the user, so another user's request with the same key is new.
+	res := ts.do(t, http.MethodPost, "/v1/movies", bob, body, key)
+	assertStatus(t, res, http.StatusCreated)
+	if got := res.header.Get("Location"); got != "/v1/movies/2" {
+		t.Errorf("got Location %q; want %q", got, "/v1/movies/2")
+	}
+
+	// The replay didn't insert a third movie.
+	res = ts.do(t, http.MethodGet, "/v1/movies/3", alice, "", nil)
+	assertStatus(t, res, http.StatusNotFound)
+
+	t.Run("DifferentBody", func(t *testing.T) {
+		res := ts.do(t, http.MethodPost, "/v1/movies", alice, `{"title": "Up", "year": 2009, "run_time": "96 mins", "genres": ["animation"]}`, key)
+
+		assertStatus(t, res, http.StatusUnprocessableEntity)
+		assertGolden(t, res)
+	})
+
+	t.Run("KeyTooLong", func(t *testing.T) {
+		res := ts.do(t, http.MethodPost, "/v1/movies", alice, body, map[string]string{"Idempotency-Key": string(bytes.Repeat([]byte("k"), 256))})
+
+		assertStatus(t, res, http.StatusBadRequest)
+		assertGolden(t, res)
+	})
+
+	t.Run("ClientErrorReplayed", func(t *testing.T) {
+		key := map[string]string{"Idempotency-Key": "0b6c3a5e-invalid"}
+
+		res := ts.do(t, http.MethodPost, "/v1/movies", alice, `{"title": ""}`, key)
+		assertStatus(t, res, http.StatusUnprocessableEntity)
+
+		res = ts.do(t, http.MethodPost, "/v1/movies", alice, `{"title": ""}`, key)
+		assertStatus(t, res, http.StatusUnprocessableEntity)
+		if got := res.header.Get("Idempotent-Replayed"); got != "true" {
+			t.Errorf("got Idempotent-Replayed %q; want %q", got, "true")
+		}
+	})
+
+	t.Run("ServerErrorNotRecorded", func(t *testing.T) {
+		key := map[string]string{"Idempotency-Key": "0b6c3a5e-failed"}
+		movies := app.models.Movies
+
+		app.models.Movies = failingMovies{MovieStore: movies}
+		res := ts.do(t, http.MethodPost, "/v1/movies", alice, body, key)
+		assertStatus(t, res, http.StatusInternalServerError)
+
+		app.models.Movies = movies
+		res = ts.do(t, http.MethodPost, "/v1/movies", alice, body, key)
+		assertStatus(t, res, http.StatusCreated)
+		if got := res.header.Get("Idempotent-Replayed"); got != "" {
+			t.Errorf("got Idempotent-Replayed %q; want none", got)
+		}
+	})
+}
+
+func TestIdempotentRegisterUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	body := `{"name": "Alice", "email": "alice@example.com", "password": "pa55word"}`
+	key := map[string]string{"Idempotency-Key": "5d1e0f2c-register"}
+
+	first := ts.do(t, http.MethodPost, "/v1/users", "", body, key)
+	assertStatus(t, first, http.StatusCreated)
+
+	retry := ts.do(t, http.MethodPost, "/v1/users", "", body, key)
+	assertStatus(t, retry, http.StatusCreated)
+	if !bytes.Equal(retry.body, first.body) {
+		t.Errorf("got replayed body %s; want %s", retry.body, first.body)
+	}
+
+	// Without the key, the retry would have failed with a duplicate email instead.
+	if sent := app.mailer.(*mockMailer).messages(); len(sent) != 1 {
+		t.Errorf("got %d welcome emails; want 1", len(sent))
+	}
+
+	// Anonymous keys are scoped to the client's address, so another client can use the
+	// same key for its own request.
+	other := ts.do(t, http.MethodPost, "/v1/users", "", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word"}`, map[string]string{
+		"Idempotency-Key": "5d1e0f2c-register",
+		"X-Forwarded-For": "203.0.113.7",
+	})
+	assertStatus(t, other, http.StatusCreated)
+	if got := other.header.Get("Idempotent-Replayed"); got != "" {
+		t.Errorf("got Idempotent-Replayed %q for another client", got)
+	}
+}
+
+// purgeCounter counts the purges of expired keys, which must each have a deadline.
+type purgeCounter struct {
+	data.IdempotencyKeyStore
+	t      *testing.T
+	purges atomic.Int32
+}
+
+func (p *purgeCounter) DeleteExpired(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		p.t.Error("got a purge without a deadline")
+	}
+	p.purges.Add(1)
+	return p.IdempotencyKeyStore.DeleteExpired(ctx)
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	app := newTestApplication(t)
+	counter := &purgeCounter{IdempotencyKeyStore: app.models.IdempotencyKeys, t: t}
+	app.models.IdempotencyKeys = counter
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		app.purgeIdempotencyKeys(ctx, time.Millisecond)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for counter.purges.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired keys weren't purged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The purge stops once its context is cancelled, and doesn't run again.
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("purge didn't stop")
+	}
+	purges := counter.purges.Load()
+	time.Sleep(10 * time.Millisecond)
+	if got := counter.purges.Load(); got != purges {
+		t.Errorf("got %d purges after stopping; want %d", got, purges)
+	}
+}
@@ -3,21 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/data/memory"
+	"github.com/danyelkeddah/go-greenlight/internal/data/sqlite"
 	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
 	"github.com/danyelkeddah/go-greenlight/internal/mailer"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
 	"github.com/danyelkeddah/go-greenlight/internal/vcs"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,14 +30,26 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
+	port    int
+	env     string
+	storage string
+	// Check requests against the OpenAPI document before they reach the handlers.
+	validateRequests bool
+	// Send every error as problem details, rather than only to clients which ask for them.
+	problemJSON bool
+	// Prefix of the type URIs of problem details, which are about:blank when it is empty.
+	problemTypeBase string
 
 	db struct {
 		dsn                string
 		maxOpenConnections int
 		maxIdleConnections int
 		maxIdleTime        string
+		queryTimeout       time.Duration
+		replicaDSNs        []string
+		replicaHealthCheck time.Duration
+		autoMigrate        bool
+		migrateLockTimeout time.Duration
 	}
 	// Add a new limiter struct containing fields for the requests-per-second and burst values,
 	// and a boolean field which we can use to enable/disable rate limiting altogether
@@ -52,24 +68,98 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	// Server errors are always logged, whatever the sample rate.
+	accessLog struct {
+		sampleRate float64
+		exclude    []string
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	batch struct {
+		maxRequests int
+	}
+	graphql struct {
+		maxDepth      int
+		maxComplexity int
+	}
+	// The gRPC server is disabled when its port is 0, as it is unless asked for, since its
+	// calls skip the HTTP middleware, rate limiting included.
+	grpc struct {
+		port int
+	}
+	healthz struct {
+		checkSMTP bool
+		// The server keeps serving for drainDelay after a signal to stop, while the readiness
+		// check reports it is shutting down, so load balancers stop sending it requests first.
+		drainDelay time.Duration
+	}
+	// SIGHUP switches between the level and DEBUG, and the admin listener can change it.
+	log struct {
+		level           jsonlog.Level
+		stackTraceLevel jsonlog.Level
+	}
+	// The admin listener is disabled when its address is empty. It needs a token, a password
+	// or both.
+	admin struct {
+		addr     string
+		username string
+		password string
+		token    string
+	}
+	// Tracing is disabled when the exporter is "none".
+	tracing struct {
+		exporter     string
+		otlpEndpoint string
+		sampleRate   float64
+	}
+	// The movie cache is disabled when its size is 0.
+	movieCache struct {
+		size int
+		ttl  time.Duration
+	}
 }
 
 type application struct {
 	config config
 	logger *jsonlog.Logger
 	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	mailer interface {
+		Send(ctx context.Context, recipient, templateFile string, data any) error
+	}
+	wg      sync.WaitGroup
+	metrics *appMetrics
+	tracer  *trace.Tracer
+	// db is the primary database the readiness checks ping, and is nil with -storage=memory.
+	db *sql.DB
+	// latestSchemaVersion is the newest migration embedded for the database's driver, which
+	// the readiness check compares the schema with.
+	latestSchemaVersion uint
+	// shuttingDown is set once a signal to stop has been caught, so instances report they
+	// aren't ready while draining.
+	shuttingDown atomic.Bool
 }
 
 func main() {
 	var cfg config                                                                                 // create config with empty values
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")                                        // parse port from command line
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)") // parse env from command line
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
+	flag.StringVar(&cfg.storage, "storage", "database", "Storage backend (database|memory, postgres is an alias of database)")
+	flag.BoolVar(&cfg.problemJSON, "problem-json", false, "Send every error response as application/problem+json, not only those to clients which accept it")
+	flag.StringVar(&cfg.problemTypeBase, "problem-type-base", "", "URL prefixed to the error code to form the type of problem details, such as https://example.com/problems/ (empty sends about:blank)")
+	flag.BoolVar(&cfg.validateRequests, "validate-requests", false, "Validate query parameters and JSON bodies against the OpenAPI document before handlers run")
+	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "Database DSN (postgres://... or sqlite://path/to/file.db)")
 	flag.IntVar(&cfg.db.maxOpenConnections, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConnections, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL maximum duration of a single query")
+	flag.Func("db-replica-dsn", "PostgreSQL read replica DSN (may be repeated)", func(s string) error {
+		cfg.db.replicaDSNs = append(cfg.db.replicaDSNs, s)
+		return nil
+	})
+	flag.DurationVar(&cfg.db.replicaHealthCheck, "db-replica-health-interval", 5*time.Second, "Interval between read replica health checks")
+	flag.BoolVar(&cfg.db.autoMigrate, "auto-migrate", true, "Apply pending migrations at startup (off by default when -env=production)")
+	flag.DurationVar(&cfg.db.migrateLockTimeout, "migrate-lock-timeout", time.Minute, "Maximum time to wait for another instance to finish migrating")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
@@ -82,41 +172,67 @@ func main() {
 		cfg.cors.trustedOrigins = strings.Fields(s)
 		return nil
 	})
+	flag.Float64Var(&cfg.accessLog.sampleRate, "access-log-sample-rate", 1, "Fraction of requests written to the access log (server errors are always logged)")
+	flag.Func("access-log-exclude", "Paths never written to the access log (space separated)", func(s string) error {
+		cfg.accessLog.exclude = strings.Fields(s)
+		return nil
+	})
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-key-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key header are kept for replay")
+	flag.IntVar(&cfg.batch.maxRequests, "batch-max-requests", 20, "Maximum number of sub-requests in a batch request")
+	flag.IntVar(&cfg.grpc.port, "grpc-port", 0, "gRPC server port, such as 4001 (0 disables the gRPC server)")
+	flag.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 8, "Maximum depth of a GraphQL query")
+	flag.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 2000, "Maximum complexity of a GraphQL query, counting each field selected for each movie in a page")
+	flag.BoolVar(&cfg.healthz.checkSMTP, "healthz-check-smtp", false, "Fail the readiness check when the SMTP server can't be reached")
+	flag.DurationVar(&cfg.healthz.drainDelay, "healthz-drain-delay", 5*time.Second, "How long to keep serving after a signal to stop while reporting not ready, so load balancers can notice (0 stops at once)")
+	cfg.log.level, cfg.log.stackTraceLevel = jsonlog.LevelInfo, jsonlog.LevelError
+	flag.TextVar(&cfg.log.level, "log-level", cfg.log.level, "Minimum level of the entries logged (DEBUG|INFO|WARN|ERROR|FATAL|OFF)")
+	flag.TextVar(&cfg.log.stackTraceLevel, "log-stack-trace-level", cfg.log.stackTraceLevel, "Minimum level of the entries logged with a stack trace (OFF disables stack traces)")
+	flag.StringVar(&cfg.admin.addr, "admin-addr", "", "Address of the admin listener serving pprof, expvar, metrics and log level control, such as localhost:4002 (empty disables it)")
+	flag.StringVar(&cfg.admin.username, "admin-username", "admin", "Admin listener basic authentication username")
+	flag.StringVar(&cfg.admin.password, "admin-password", os.Getenv("GREENLIGHT_ADMIN_PASSWORD"), "Admin listener basic authentication password")
+	flag.StringVar(&cfg.admin.token, "admin-token", os.Getenv("GREENLIGHT_ADMIN_TOKEN"), "Admin listener static bearer token")
+	flag.StringVar(&cfg.tracing.exporter, "trace-exporter", "none", "Where spans are exported to (none|stdout|otlp)")
+	flag.StringVar(&cfg.tracing.otlpEndpoint, "trace-otlp-endpoint", "http://localhost:4318/v1/traces", "URL of the OTLP/HTTP traces receiver spans are exported to")
+	flag.Float64Var(&cfg.tracing.sampleRate, "trace-sample-rate", 1, "Fraction of new traces which are recorded (traces continued from a traceparent header follow the caller)")
+	flag.IntVar(&cfg.movieCache.size, "movie-cache-size", 0, "Maximum number of cached movie reads (0 disables the cache)")
+	flag.DurationVar(&cfg.movieCache.ttl, "movie-cache-ttl", 30*time.Second, "Maximum time a movie read is cached for")
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: api [flags]\n       api [flags] migrate <command>\n\nflags:\n")
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
+	// postgres is the name the database backend had before SQLite was supported.
+	if cfg.storage == "postgres" {
+		cfg.storage = "database"
+	}
 	if *displayVersion {
 		fmt.Printf("Version:\t%s\n", version)
 		os.Exit(0)
 	}
 
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
-	db, err := openDB(cfg)
-
-	if err != nil {
-		logger.PrintFatal(err, nil)
+	// Migrations are applied automatically outside production, unless asked otherwise.
+	if !isFlagSet("auto-migrate") && cfg.env == "production" {
+		cfg.db.autoMigrate = false
 	}
 
-	defer db.Close()
-
-	logger.PrintInfo("database connection pool established", nil)
-
-	migrationDriver, err := postgres.WithInstance(db, &postgres.Config{})
-	if err != nil {
-		logger.PrintFatal(err, nil)
+	if flag.Arg(0) == "migrate" {
+		err := runMigrateCommand(cfg, flag.Args()[1:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	pwd, _ := os.Getwd()
+	logger := jsonlog.New(os.Stdout, cfg.log.level)
+	logger.SetStackTraceLevel(cfg.log.stackTraceLevel)
 
-	migrator, err := migrate.NewWithDatabaseInstance(fmt.Sprintf("file:///%s/migrations", pwd), "postgres", migrationDriver)
-	if err != nil {
-		logger.PrintFatal(err, nil)
+	if cfg.admin.addr != "" && cfg.admin.password == "" && cfg.admin.token == "" {
+		logger.PrintFatal(errors.New("-admin-addr requires -admin-password or -admin-token"), nil)
 	}
-	err = migrator.Up()
-	if err != nil && err != migrate.ErrNoChange {
-		logger.PrintFatal(err, nil)
-	}
-	logger.PrintInfo("database migrations applied", nil)
 
 	expvar.NewString("version").Set(version)
 
@@ -124,19 +240,126 @@ func main() {
 		return runtime.NumGoroutine()
 	}))
 
-	expvar.Publish("database", expvar.Func(func() any {
-		return db.Stats()
-	}))
-
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	var (
+		models  data.Models
+		primary *sql.DB
+		latest  uint
+		dbStats func() map[string]sql.DBStats
+	)
+
+	switch cfg.storage {
+	case "database":
+		driver := dbDriver(cfg.db.dsn)
+
+		db, err := openDB(cfg, cfg.db.dsn)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer db.Close()
+		primary = db
+
+		logger.PrintInfo("database connection pool established", map[string]any{
+			"driver": driver,
+		})
+
+		latest, err = latestMigration(driver)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		if cfg.db.autoMigrate {
+			err = migrateDB(cfg)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			logger.PrintInfo("database migrations applied", nil)
+		} else {
+			current, latest, err := checkSchemaVersion(cfg)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			logger.PrintInfo("database schema is up to date", map[string]any{
+				"version": current,
+				"latest":  latest,
+			})
+		}
+
+		switch driver {
+		case "sqlite":
+			if len(cfg.db.replicaDSNs) > 0 {
+				logger.PrintFatal(errors.New("read replicas are only supported with PostgreSQL"), nil)
+			}
+
+			expvar.Publish("database", expvar.Func(func() any {
+				return db.Stats()
+			}))
+			dbStats = func() map[string]sql.DBStats {
+				return map[string]sql.DBStats{"primary": db.Stats()}
+			}
+
+			models = sqlite.NewModels(db, cfg.db.queryTimeout)
+		default:
+			replicas, err := openReplicas(cfg, db)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+
+			defer replicas.Close()
+
+			if len(cfg.db.replicaDSNs) > 0 {
+				go replicas.MonitorHealth(cfg.db.replicaHealthCheck)
+				logger.PrintInfo("database read replicas established", map[string]any{
+					"replicas": len(cfg.db.replicaDSNs),
+				})
+			}
+
+			expvar.Publish("database", expvar.Func(func() any {
+				return replicas.Stats()
+			}))
+			dbStats = replicas.PoolStats
+
+			models = data.NewModels(db, cfg.db.queryTimeout, replicas)
+		}
+	case "memory":
+		logger.PrintInfo("using in-memory storage, all data will be lost on shutdown", nil)
+		models = memory.New()
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown storage backend %q", cfg.storage), nil)
+	}
+
+	tracer, err := newTracer(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// Queries are traced below the movie cache, so its hits don't show up as queries.
+	if tracer != nil {
+		models = data.Traced(models)
+	}
+
+	if cfg.movieCache.size > 0 {
+		cache := data.NewMovieCache(cfg.movieCache.size, cfg.movieCache.ttl)
+		models = cache.Wrap(models)
+
+		expvar.Publish("movie_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+	}
+
 	app := &application{ // app has config and logger
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  models,
+		mailer:  mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		metrics: newMetrics(dbStats),
+		tracer:  tracer,
+		db:      primary,
+
+		latestSchemaVersion: latest,
 	}
 
 	err = app.serve()
@@ -146,20 +369,96 @@ func main() {
 
 }
 
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool
-	db, err := sql.Open("postgres", cfg.db.dsn)
-	if err != nil {
-		return nil, err
+// dbDriver returns the database/sql driver name for the DSN, based on its scheme.
+func dbDriver(dsn string) string {
+	if strings.HasPrefix(dsn, sqlite.Scheme+"://") {
+		return "sqlite"
 	}
+	return "postgres"
+}
+
+// openReplicas opens a connection pool for every read replica. Replicas which can't be
+// reached at startup are still added, and rejoin the rotation once their health checks pass.
+// A replica given twice is rejected, as it would get twice the share of the reads.
+func openReplicas(cfg config, primary *sql.DB) (rs *data.ReplicaSet, err error) {
+	replicas := make(map[string]*sql.DB, len(cfg.db.replicaDSNs))
+	dsns := make(map[string]bool, len(cfg.db.replicaDSNs))
+	defer func() {
+		if err != nil {
+			for _, db := range replicas {
+				db.Close()
+			}
+		}
+	}()
+
+	for i, dsn := range cfg.db.replicaDSNs {
+		name := fmt.Sprintf("replica-%d", i+1)
+		if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+			name = u.Redacted()
+		}
+		if _, ok := replicas[name]; ok || dsns[dsn] {
+			return nil, fmt.Errorf("read replica %s is given more than once", name)
+		}
+		dsns[dsn] = true
+
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		replicas[name] = db
+
+		err = configurePool(cfg, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data.NewReplicaSet(primary, replicas), nil
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func configurePool(cfg config, db *sql.DB) error {
 	db.SetMaxOpenConns(cfg.db.maxOpenConnections)
 	db.SetMaxIdleConns(cfg.db.maxIdleConnections)
 	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	db.SetConnMaxIdleTime(duration)
 
+	return nil
+}
+
+func openDB(cfg config, dsn string) (*sql.DB, error) {
+	driver := dbDriver(dsn)
+	if driver == "sqlite" {
+		var err error
+		dsn, err = sqlite.DataSourceName(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use sql.Open() to create an empty connection pool
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = configurePool(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a context with a 5-second timeout deadline.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/danyelkeddah/go-greenlight/internal/metrics"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// appMetrics are the metrics served at /metrics by the admin listener.
+type appMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	mailSent        *metrics.CounterVec
+	rateLimited     *metrics.Counter
+	backgroundTasks *metrics.Gauge
+}
+
+// newMetrics registers the application's metrics. dbStats returns the statistics of each
+// database connection pool by name, and is nil when the models aren't backed by a database.
+func newMetrics(dbStats func() map[string]sql.DBStats) *appMetrics {
+	r := metrics.NewRegistry()
+
+	m := &appMetrics{
+		registry:        r,
+		requests:        r.NewCounterVec("greenlight_http_requests_total", "Number of HTTP requests served, by route pattern, method and status.", "route", "method", "status"),
+		requestDuration: r.NewHistogramVec("greenlight_http_request_duration_seconds", "Time taken to serve HTTP requests, by route pattern, method and status.", metrics.DefBuckets, "route", "method", "status"),
+		mailSent:        r.NewCounterVec("greenlight_mail_sent_total", "Number of emails sent, by template and result.", "template", "result"),
+		rateLimited:     r.NewCounter("greenlight_rate_limit_rejections_total", "Number of requests rejected by the rate limiter."),
+		backgroundTasks: r.NewGauge("greenlight_background_tasks", "Number of background tasks, such as sending emails, still running."),
+	}
+
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(runtime.NumGoroutine())}}
+	})
+
+	if dbStats != nil {
+		pool := func(value func(sql.DBStats) float64) func() []metrics.Sample {
+			return func() []metrics.Sample {
+				stats := dbStats()
+				names := make([]string, 0, len(stats))
+				for name := range stats {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				samples := make([]metrics.Sample, len(names))
+				for i, name := range names {
+					samples[i] = metrics.Sample{LabelValues: []string{name}, Value: value(stats[name])}
+				}
+				return samples
+			}
+		}
+
+		labels := []string{"pool"}
+		r.NewGaugeFunc("greenlight_db_max_open_connections", "Maximum number of open connections to the database.", labels, pool(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+		r.NewGaugeFunc("greenlight_db_open_connections", "Number of established connections to the database, in use or idle.", labels, pool(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+		r.NewGaugeFunc("greenlight_db_in_use_connections", "Number of connections to the database currently in use.", labels, pool(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+		r.NewGaugeFunc("greenlight_db_idle_connections", "Number of idle connections to the database.", labels, pool(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+		r.NewCounterFunc("greenlight_db_wait_count_total", "Number of times a query waited for a connection.", labels, pool(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+		r.NewCounterFunc("greenlight_db_wait_duration_seconds_total", "Total time queries waited for a connection.", labels, pool(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	}
+
+	return m
+}
+
+// recordMetrics counts every request, and how long it took, by the pattern of the route it
+// matched rather than its path, so that IDs don't create a time series each.
+func (a *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := a.contextSetRequestInfo(r)
+		rw := &responseObserver{ResponseWriter: w}
+
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := info.route
+			if route == "" {
+				route = "unmatched"
+			}
+
+			labels := []string{route, metricsMethod(r.Method), strconv.Itoa(status)}
+			a.metrics.requests.With(labels...).Inc()
+			a.metrics.requestDuration.With(labels...).Observe(time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// metricsMethod returns the method label of a request. Clients can send any token as the
+// method, so those outside the standard methods share the label OTHER rather than each
+// creating time series which are never freed.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// sendMail sends an email through the mailer, counting it by template and result.
+func (a *application) sendMail(ctx context.Context, recipient, templateFile string, data any) error {
+	err := a.mailer.Send(ctx, recipient, templateFile, data)
+
+	logger := a.logger.Component("mailer")
+	if err != nil {
+		a.metrics.mailSent.With(templateFile, "failure").Inc()
+		logger.PrintWarn("email failed", map[string]any{"template": templateFile, "error": err.Error()})
+		return err
+	}
+
+	a.metrics.mailSent.With(templateFile, "success").Inc()
+	logger.PrintDebug("email sent", map[string]any{"template": templateFile})
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	app.metrics = newMetrics(func() map[string]sql.DBStats {
+		return map[string]sql.DBStats{"primary": {MaxOpenConnections: 25, OpenConnections: 3, InUse: 1, Idle: 2}}
+	})
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 1
+	ts := newTestServer(t, app)
+	seedMovies(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+	ts.do(t, http.MethodGet, "/v1/movies/1", token, "", nil)
+	ts.do(t, http.MethodGet, "/v1/movies/2", token, "", nil)
+	ts.do(t, http.MethodGet, "/v1/nowhere", "", "", nil)
+	ts.do(t, "BREW", "/v1/nowhere", "", "", nil)
+	ts.do(t, "SPILL", "/v1/nowhere", "", "", nil)
+	ts.do(t, http.MethodPost, "/v1/users", "", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word"}`, nil)
+
+	app.config.admin.token = "s3cret"
+	res := newAdminTestServer(t, app).do(t, http.MethodGet, "/metrics", "s3cret", "", nil)
+	assertStatus(t, res, http.StatusOK)
+	if got := res.header.Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+
+	for _, want := range []string{
+		"# TYPE greenlight_http_requests_total counter",
+		// Both movies are counted under their route's pattern, and only the first was
+		// allowed through by the rate limiter.
+		`greenlight_http_requests_total{route="/v1/movies/:id",method="GET",status="200"} 1`,
+		`greenlight_http_requests_total{route="/v1/movies/:id",method="GET",status="429"} 1`,
+		`greenlight_http_requests_total{route="unmatched",method="GET",status="404"} 1`,
+		// Non-standard methods share a label.
+		`greenlight_http_requests_total{route="unmatched",method="OTHER",status="404"} 2`,
+		`greenlight_http_request_duration_seconds_bucket{route="/v1/movies/:id",method="GET",status="200",le="+Inf"} 1`,
+		`greenlight_http_request_duration_seconds_count{route="/v1/users",method="POST",status="201"} 1`,
+		"greenlight_rate_limit_rejections_total 1",
+		`greenlight_mail_sent_total{template="user_welcome.go.html",result="success"} 1`,
+		"greenlight_background_tasks 0",
+		`greenlight_db_open_connections{pool="primary"} 3`,
+		`greenlight_db_max_open_connections{pool="primary"} 25`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(string(res.body), want+"\n") {
+			t.Errorf("got metrics without %q:\n%s", want, res.body)
+		}
+	}
+}
+
+// failingMailer fails to send every email.
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, string, string, any) error {
+	return errors.New("smtp: connection refused")
+}
+
+func TestSendMailFailure(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = jsonlog.New(&buf, jsonlog.LevelDebug)
+	app.mailer = failingMailer{}
+
+	err := app.sendMail(context.Background(), "bob@example.com", "user_welcome.go.html", nil)
+	if err == nil {
+		t.Fatal("got no error from a failing mailer")
+	}
+
+	// The failure is logged as a warning, in agreement with the metric.
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["level"] != "WARN" || entries[0]["message"] != "email failed" {
+		t.Fatalf("got log entries %v", entries)
+	}
+	if properties, _ := entries[0]["properties"].(map[string]any); properties["error"] != err.Error() {
+		t.Errorf("got properties %v; want the error", properties)
+	}
+
+	app.config.admin.token = "s3cret"
+	res := newAdminTestServer(t, app).do(t, http.MethodGet, "/metrics", "s3cret", "", nil)
+	if want := `greenlight_mail_sent_total{template="user_welcome.go.html",result="failure"} 1`; !strings.Contains(string(res.body), want+"\n") {
+		t.Errorf("got metrics without %q:\n%s", want, res.body)
+	}
+}
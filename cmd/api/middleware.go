@@ -1,18 +1,147 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/danyelkeddah/go-greenlight/internal/data"
 	"github.com/danyelkeddah/go-greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 )
 
+// requestIDPattern matches the X-Request-ID values accepted from clients and proxies, so
+// that they are safe to log and echo.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID gives every request an ID, taken from its X-Request-ID header or generated, which
+// is echoed in the X-Request-ID response header, added to error bodies and logged along with
+// every entry written through loggerFor while the request is served.
+func (a *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, a.contextSetRequestID(r, id))
+	})
+}
+
+// responseObserver passes a response through to the client while counting the bytes of its
+// body. It keeps the Flusher and Hijacker interfaces of the underlying ResponseWriter
+// available to handlers.
+type responseObserver struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *responseObserver) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseObserver) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *responseObserver) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (rw *responseObserver) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err == nil && rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying ResponseWriter.
+func (rw *responseObserver) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// accessLog writes an entry for every request once it has been served, with its status, the
+// size of the response body, how long it took, and who sent it. Requests to the paths given
+// by -access-log-exclude are never logged, and of the others only the fraction given by
+// -access-log-sample-rate is, except for those which failed with a server error.
+func (a *application) accessLog(next http.Handler) http.Handler {
+	excluded := make(map[string]bool)
+	for _, path := range a.config.accessLog.exclude {
+		excluded[path] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if excluded[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		r, info := a.contextSetRequestInfo(r)
+		rw := &responseObserver{ResponseWriter: w}
+
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status < http.StatusInternalServerError && mathrand.Float64() >= a.config.accessLog.sampleRate {
+				return
+			}
+
+			properties := map[string]any{
+				"request_method": r.Method,
+				"request_url":    r.URL.String(),
+				"status":         status,
+				"bytes":          rw.bytes,
+				"duration_ms":    float64(time.Since(start).Microseconds()) / 1000,
+				"client_ip":      realip.FromRequest(r),
+			}
+			if info.route != "" {
+				properties["route"] = info.route
+			}
+			a.loggerFor(r).PrintInfo("request served", properties)
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
 func (a *application) recoverPanic(w http.ResponseWriter, r *http.Request, err interface{}) {
 	w.Header().Set("Connection", "close")
 	a.serverErrorResponse(w, r, fmt.Errorf("%s", err))
@@ -45,7 +174,8 @@ func (a *application) rateLimit(next http.HandlerFunc) http.HandlerFunc {
 	}()
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if a.config.limiter.enabled {
+		// The sub-requests of a batch aren't limited, as the batch itself already was.
+		if a.config.limiter.enabled && !a.contextIsBatched(r) {
 			ip := realip.FromRequest(r)
 
 			mu.Lock()
@@ -60,6 +190,7 @@ func (a *application) rateLimit(next http.HandlerFunc) http.HandlerFunc {
 
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
+				a.metrics.rateLimited.Inc()
 				a.rateLimitExceededResponse(w, r)
 				return
 			}
@@ -75,6 +206,12 @@ func (a *application) authenticate(next http.HandlerFunc) http.HandlerFunc {
 		// indicates any cache that the response may vary based on the value of the authorization header in the request.
 		w.Header().Add("Vary", "Authorization")
 
+		// The sub-requests of a batch are already authenticated as the caller of the batch.
+		if a.contextIsBatched(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		authorizationHeader := r.Header.Get("Authorization")
 
 		if authorizationHeader == "" {
@@ -97,7 +234,7 @@ func (a *application) authenticate(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		user, err := a.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := a.modelsFor(r).Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -144,9 +281,12 @@ func (a *application) enableCORS(next http.HandlerFunc) http.HandlerFunc {
 				if origin == a.config.cors.trustedOrigins[i] {
 					// if match, them set Access-Control-Allow-Origin as origin value and break out of the loop
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					// Let browser clients read the ETag they need for conditional requests, tell
+					// replayed responses apart and quote the ID of a request.
+					w.Header().Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, X-Request-ID")
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						w.Header().Set("Access-Control-Request-Method", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, X-Expected-Version, Idempotency-Key, X-Request-ID, traceparent")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -159,19 +299,3 @@ func (a *application) enableCORS(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
-
-//func (a *application) metrics(next http.HandlerFunc) http.HandlerFunc {
-//	totalRequestsReceived := expvar.NewInt("total_requests_received")
-//	totalResponsesSent := expvar.NewInt("total_responses_sent")
-//	totalProcessingTimeMicrosecond := expvar.NewInt("total_processing_time_μs")
-//
-//	return func(w http.ResponseWriter, r *http.Request) {
-//		start := time.Now()
-//		totalRequestsReceived.Add(1)
-//		next.ServeHTTP(w, r)
-//		totalResponsesSent.Add(1)
-//		duration := time.Since(start).Milliseconds()
-//		totalProcessingTimeMicrosecond.Add(duration)
-//	}
-//
-//}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"MissingScheme", "AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized},
+		{"WrongScheme", "Basic AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized},
+		{"MalformedToken", "Bearer short", http.StatusUnauthorized},
+		{"UnknownToken", "Bearer AAAAAAAAAAAAAAAAAAAAAAAAAA", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"Authorization": tt.authorization})
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+			if got := res.header.Get("WWW-Authenticate"); got != "Bearer" {
+				t.Errorf("got WWW-Authenticate %q; want %q", got, "Bearer")
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 2
+	ts := newTestServer(t, app)
+
+	for i := 0; i < 2; i++ {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", nil)
+		assertStatus(t, res, http.StatusOK)
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", nil)
+	assertStatus(t, res, http.StatusTooManyRequests)
+	assertGolden(t, res)
+
+	// Requests from another client have their own allowance.
+	res = ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+	assertStatus(t, res, http.StatusOK)
+}
+
+func TestEnableCORS(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	t.Run("PreflightFromTrustedOrigin", func(t *testing.T) {
+		res := ts.do(t, http.MethodOptions, "/v1/movies/1", "", "", map[string]string{
+			"Origin":                        trustedOrigin,
+			"Access-Control-Request-Method": http.MethodPatch,
+		})
+
+		assertStatus(t, res, http.StatusOK)
+		if got := res.header.Get("Access-Control-Allow-Origin"); got != trustedOrigin {
+			t.Errorf("got Access-Control-Allow-Origin %q; want %q", got, trustedOrigin)
+		}
+		if got := res.header.Get("Access-Control-Allow-Methods"); got != "OPTIONS, PUT, PATCH, DELETE" {
+			t.Errorf("got Access-Control-Allow-Methods %q", got)
+		}
+		if got := res.header.Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type, If-Match, If-None-Match, X-Expected-Version, Idempotency-Key, X-Request-ID, traceparent" {
+			t.Errorf("got Access-Control-Allow-Headers %q", got)
+		}
+	})
+
+	t.Run("PreflightFromUntrustedOrigin", func(t *testing.T) {
+		res := ts.do(t, http.MethodOptions, "/v1/movies/1", "", "", map[string]string{
+			"Origin":                        "https://evil.example.com",
+			"Access-Control-Request-Method": http.MethodPatch,
+		})
+
+		assertStatus(t, res, http.StatusOK)
+		if got := res.header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("got Access-Control-Allow-Origin %q; want none", got)
+		}
+		if got := res.header.Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("got Access-Control-Allow-Methods %q; want none", got)
+		}
+	})
+
+	t.Run("SimpleRequestFromTrustedOrigin", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"Origin": trustedOrigin})
+
+		assertStatus(t, res, http.StatusOK)
+		if got := res.header.Get("Access-Control-Allow-Origin"); got != trustedOrigin {
+			t.Errorf("got Access-Control-Allow-Origin %q; want %q", got, trustedOrigin)
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	t.Run("Generated", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies/1", "", "", nil)
+
+		id := res.header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) || len(id) != 32 {
+			t.Fatalf("got X-Request-ID %q; want 32 hex digits", id)
+		}
+
+		var body struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(res.body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.RequestID != id {
+			t.Errorf("got request_id %q in the body; want %q", body.RequestID, id)
+		}
+	})
+
+	t.Run("Accepted", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"X-Request-ID": "client-42.retry:1"})
+
+		if got := res.header.Get("X-Request-ID"); got != "client-42.retry:1" {
+			t.Errorf("got X-Request-ID %q; want client-42.retry:1", got)
+		}
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"X-Request-ID": "not a valid\tid"})
+
+		if got := res.header.Get("X-Request-ID"); len(got) != 32 {
+			t.Errorf("got X-Request-ID %q; want a generated ID", got)
+		}
+	})
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+	user := insertUser(t, app, "Alice", "alice@example.com", true)
+
+	handler := app.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.serverErrorResponse(w, app.contextSetUser(r, user), errors.New("boom"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry struct {
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties"`
+		Trace      string         `json:"trace"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{"request_id": "abc-123", "user_id": float64(1), "request_method": "GET", "request_url": "/v1/movies/1"}
+	for key, value := range want {
+		if entry.Properties[key] != value {
+			t.Errorf("got %s %v; want %v", key, entry.Properties[key], value)
+		}
+	}
+	if entry.Trace == "" {
+		t.Error("got no stack trace for an error")
+	}
+}
+
+// logEntries decodes the entries written to buf by a jsonlog.Logger.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var entries []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry map[string]any
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+	app.config.accessLog.sampleRate = 1
+	app.config.accessLog.exclude = []string{"/v1/healthcheck"}
+	ts := newTestServer(t, app)
+	seedMovies(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+	res := ts.do(t, http.MethodGet, "/v1/movies/1", token, "", map[string]string{"X-Request-ID": "abc-123"})
+	assertStatus(t, res, http.StatusOK)
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", nil)
+
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries; want 1: %v", len(entries), entries)
+	}
+
+	properties, _ := entries[0]["properties"].(map[string]any)
+	want := map[string]any{
+		"request_method": "GET",
+		"request_url":    "/v1/movies/1",
+		"route":          "/v1/movies/:id",
+		"status":         float64(200),
+		"bytes":          float64(len(res.body)),
+		"client_ip":      "127.0.0.1",
+		"request_id":     "abc-123",
+		"user_id":        float64(1),
+	}
+	for key, value := range want {
+		if properties[key] != value {
+			t.Errorf("got %s %v; want %v", key, properties[key], value)
+		}
+	}
+	if _, ok := properties["duration_ms"]; !ok {
+		t.Error("got no duration_ms")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApplication(t)
+	app.logger = jsonlog.New(&buf, jsonlog.LevelInfo)
+	app.config.accessLog.sampleRate = 0
+
+	handler := app.accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+	// Server errors are logged whatever the sample rate.
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["properties"].(map[string]any)["status"] != float64(502) {
+		t.Errorf("got log entries %v; want only the 502", entries)
+	}
+}
+
+func TestResponseObserver(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := httptest.NewServer(app.accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("got a ResponseWriter which isn't a Flusher")
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+		buf.Flush()
+	})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d; want %d", res.StatusCode, http.StatusNoContent)
+	}
+}
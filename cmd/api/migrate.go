@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	migratesqlite "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"io"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = `usage: api [flags] migrate <command>
+
+commands:
+  up         apply all pending migrations
+  down [N]   roll back the last N migrations (default 1)
+  version    print the current schema version
+  force V    set the schema version to V without running migrations, clearing the dirty flag
+`
+
+// newMigrator returns a migrator for the embedded migrations matching the database driver.
+// It opens a connection pool of its own, which the returned function closes along with the
+// migrator.
+//
+// The PostgreSQL driver holds a pg_advisory_lock for the duration of every operation, so
+// several replicas starting at once run the migrations one after another instead of racing
+// each other; the others wait up to -migrate-lock-timeout and then find nothing to do.
+// SQLite is meant for a single node and only locks within the process.
+func newMigrator(cfg config) (*migrate.Migrate, func(), error) {
+	if cfg.storage != "database" {
+		return nil, nil, fmt.Errorf("migrations require -storage=database, not %q", cfg.storage)
+	}
+
+	driver := dbDriver(cfg.db.dsn)
+
+	db, err := openDB(cfg, cfg.db.dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		migrationDriver database.Driver
+		dir             = migrations.PostgresDir
+	)
+
+	switch driver {
+	case "sqlite":
+		migrationDriver, err = migratesqlite.WithInstance(db, &migratesqlite.Config{})
+		dir = migrations.SQLiteDir
+	default:
+		migrationDriver, err = postgres.WithInstance(db, &postgres.Config{})
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	sourceDriver, err := iofs.New(migrations.FS, dir)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	migrator, err := migrate.NewWithInstance("iofs", sourceDriver, driver, migrationDriver)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	migrator.LockTimeout = cfg.db.migrateLockTimeout
+
+	closeFn := func() {
+		// The PostgreSQL migration driver only releases its own connection, so close the
+		// pool explicitly as well.
+		migrator.Close()
+		db.Close()
+	}
+
+	return migrator, closeFn, nil
+}
+
+// migrateDB applies every pending migration.
+func migrateDB(cfg config) error {
+	migrator, closeMigrator, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeMigrator()
+
+	err = migrator.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
+
+// latestVersion returns the version of the newest embedded migration.
+func latestVersion(sourceDriver source.Driver) (uint, error) {
+	version, err := sourceDriver.First()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		next, err := sourceDriver.Next(version)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return version, nil
+			}
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// latestMigration returns the version of the newest embedded migration for the driver.
+func latestMigration(driver string) (uint, error) {
+	dir := migrations.PostgresDir
+	if driver == "sqlite" {
+		dir = migrations.SQLiteDir
+	}
+	sourceDriver, err := iofs.New(migrations.FS, dir)
+	if err != nil {
+		return 0, err
+	}
+	defer sourceDriver.Close()
+
+	return latestVersion(sourceDriver)
+}
+
+// checkSchemaVersion is run at startup when migrations aren't applied automatically. It
+// refuses to start against a dirty schema, or one which is missing migrations this binary
+// depends on. It returns the current and the latest known version.
+func checkSchemaVersion(cfg config) (current uint, latest uint, err error) {
+	migrator, closeMigrator, err := newMigrator(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeMigrator()
+
+	latest, err = latestMigration(dbDriver(cfg.db.dsn))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	current, dirty, err := migrator.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		return 0, latest, fmt.Errorf("database has no schema yet, run \"api migrate up\" or start with -auto-migrate")
+	case err != nil:
+		return 0, 0, err
+	case dirty:
+		return current, latest, fmt.Errorf("database schema version %d is dirty, fix it and run \"api migrate force %d\"", current, current)
+	case current < latest:
+		return current, latest, fmt.Errorf("database schema version %d is behind the latest migration %d, run \"api migrate up\"", current, latest)
+	}
+
+	return current, latest, nil
+}
+
+// runMigrateCommand implements the "migrate" subcommand, writing its output to w.
+func runMigrateCommand(cfg config, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, closeMigrator, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeMigrator()
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		err = migrator.Steps(-steps)
+	case "version":
+		version, dirty, err := migrator.Version()
+		if errors.Is(err, migrate.ErrNilVersion) {
+			fmt.Fprintln(w, "no migrations applied")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "version: %d\ndirty: %t\n", version, dirty)
+		return nil
+	case "force":
+		if len(args) < 2 {
+			return errors.New("force requires a version")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return migrator.Force(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n\n%s", args[0], migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		fmt.Fprintln(w, "no change")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	version, _, err := migrator.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Fprintln(w, "all migrations rolled back")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "database schema is at version %d\n", version)
+	return nil
+}
@@ -8,25 +8,55 @@ import (
 	"net/http"
 )
 
-func (a *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		RunTime data.Runtime `json:"run_time"`
-		Genres  []string     `json:"genres"`
+// movieInput holds the fields of a movie which clients can edit. It is the body of a create
+// request, and the document which PATCH requests are applied to.
+type movieInput struct {
+	Title            string       `json:"title"`
+	Year             int32        `json:"year"`
+	RunTime          data.Runtime `json:"run_time"`
+	Genres           []string     `json:"genres"`
+	Synopsis         string       `json:"synopsis"`
+	Rating           string       `json:"rating"`
+	ReleaseDate      data.Date    `json:"release_date"`
+	OriginalLanguage string       `json:"original_language"`
+}
+
+func newMovieInput(movie *data.Movie) movieInput {
+	return movieInput{
+		Title:            movie.Title,
+		Year:             movie.Year,
+		RunTime:          movie.RunTime,
+		Genres:           movie.Genres,
+		Synopsis:         movie.Synopsis,
+		Rating:           movie.Rating,
+		ReleaseDate:      movie.ReleaseDate,
+		OriginalLanguage: movie.OriginalLanguage,
 	}
+}
+
+// copyTo sets the editable fields of movie, leaving its ID and version alone.
+func (input movieInput) copyTo(movie *data.Movie) {
+	movie.Title = input.Title
+	movie.Year = input.Year
+	movie.RunTime = input.RunTime
+	movie.Genres = input.Genres
+	movie.Synopsis = input.Synopsis
+	movie.Rating = input.Rating
+	movie.ReleaseDate = input.ReleaseDate
+	movie.OriginalLanguage = input.OriginalLanguage
+}
+
+func (a *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
+	var input movieInput
 
 	err := a.readJSON(w, r, &input)
 	if err != nil {
 		a.badRequestResponse(w, r, err)
 		return
 	}
-	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		RunTime: input.RunTime,
-		Genres:  input.Genres,
-	}
+	movie := &data.Movie{}
+	input.copyTo(movie)
+
 	v := validator.New()
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -34,13 +64,14 @@ func (a *application) createMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = a.models.Movies.Insert(movie)
+	err = a.modelsFor(r).Movies.Insert(r.Context(), movie)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	err = a.writeJson(w, http.StatusCreated, envelop{"movie": movie}, headers)
 	if err != nil {
@@ -54,7 +85,7 @@ func (a *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 		a.notFoundResponse(w, r)
 		return
 	}
-	movie, err := a.models.Movies.Get(id)
+	movie, err := a.modelsFor(r).Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -64,7 +95,7 @@ func (a *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	err = a.writeJson(w, http.StatusOK, envelop{"movie": movie}, nil)
+	err = a.writeJSONWithETag(w, r, envelop{"movie": movie}, movieETag(movie))
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -74,8 +105,12 @@ func (a *application) updateMovieHandler(w http.ResponseWriter, r *http.Request)
 	id, err := a.readIdParam(r)
 	if err != nil {
 		a.notFoundResponse(w, r)
+		return
 	}
-	movie, err := a.models.Movies.Get(id)
+
+	// Read the movie from the primary, as a replica may not have caught up with the
+	// latest version yet and the update would then fail with an edit conflict.
+	movie, err := a.modelsFor(r).Movies.Get(data.WithPrimary(r.Context()), id)
 
 	if err != nil {
 		switch {
@@ -87,29 +122,45 @@ func (a *application) updateMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"run_time"`
-		Genres  []string      `json:"genres"`
-	}
-
-	err = a.readJSON(w, r, &input)
+	// Clients send the version they edited in If-Match or X-Expected-Version, so changes
+	// made by someone else after they fetched the movie aren't silently overwritten.
+	conditional, err := checkMoviePreconditions(r, movie)
 	if err != nil {
-		a.badRequestResponse(w, r, err)
+		switch {
+		case errors.Is(err, errPreconditionFailed):
+			a.preconditionFailedResponse(w, r)
+		default:
+			a.badRequestResponse(w, r, err)
+		}
 		return
 	}
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
 
-	if input.Runtime != nil {
-		movie.RunTime = *input.Runtime
+	// The patch is applied to the movie's editable fields, so a JSON Merge Patch can clear
+	// a field with null and a JSON Patch can address single genres by their index. The
+	// patched movie is then validated as a whole.
+	mediaType, patch, err := a.readPatch(w, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			a.unsupportedMediaTypeResponse(w, r)
+		default:
+			a.badRequestResponse(w, r, err)
+		}
+		return
 	}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+	var input movieInput
+	err = applyPatch(newMovieInput(movie), mediaType, patch, &input)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPatchNotApplicable):
+			a.patchConflictResponse(w, r, err)
+		default:
+			a.badRequestResponse(w, r, err)
+		}
+		return
 	}
+	input.copyTo(movie)
 
 	v := validator.New()
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -117,9 +168,11 @@ func (a *application) updateMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = a.models.Movies.Update(movie)
+	err = a.modelsFor(r).Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			a.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			a.editConflictResponse(w, r)
 		default:
@@ -128,7 +181,10 @@ func (a *application) updateMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = a.writeJson(w, http.StatusOK, envelop{"movie": movie}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = a.writeJson(w, http.StatusOK, envelop{"movie": movie}, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -142,11 +198,42 @@ func (a *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = a.models.Movies.Delete(id)
+	// Unconditional deletes remove whichever version is current. Otherwise the movie is
+	// loaded to check the preconditions against, and only that version is deleted.
+	var version int32
+	if r.Header.Get("If-Match") != "" || r.Header.Get("X-Expected-Version") != "" {
+		movie, err := a.modelsFor(r).Movies.Get(data.WithPrimary(r.Context()), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				a.notFoundResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		_, err = checkMoviePreconditions(r, movie)
+		if err != nil {
+			switch {
+			case errors.Is(err, errPreconditionFailed):
+				a.preconditionFailedResponse(w, r)
+			default:
+				a.badRequestResponse(w, r, err)
+			}
+			return
+		}
+
+		version = movie.Version
+	}
+
+	err = a.modelsFor(r).Movies.Delete(r.Context(), id, version)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			a.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			a.preconditionFailedResponse(w, r)
 		default:
 			a.serverErrorResponse(w, r, err)
 		}
@@ -159,35 +246,60 @@ func (a *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func (a *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Title  string
-		Genres []string
-		data.Filters
+// movieListInput holds the filters, sorting and pagination of a movie list.
+type movieListInput struct {
+	Title          string
+	Genres         []string
+	Rating         string
+	ReleasedAfter  data.Date
+	ReleasedBefore data.Date
+	data.Filters
+}
+
+var movieSortSafeList = []string{"id", "title", "year", "runtime", "release_date", "-id", "-title", "-year", "-runtime", "-release_date"}
+
+func validateMovieListInput(v *validator.Validator, input *movieListInput) {
+	if input.Rating != "" {
+		v.Check(validator.PermittedValue(input.Rating, data.Ratings...), "rating", "must be one of G, PG, PG-13, R or NC-17")
 	}
 
+	if !input.ReleasedAfter.IsZero() && !input.ReleasedBefore.IsZero() {
+		v.Check(!input.ReleasedAfter.After(input.ReleasedBefore.Time), "released_after", "must not be after released_before")
+	}
+
+	data.ValidateFilters(v, input.Filters)
+}
+
+func (a *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input movieListInput
+
 	v := validator.New()
 	qs := r.URL.Query()
 
 	input.Title = a.readString(qs, "title", "")
 	input.Genres = a.readCSV(qs, "genres", []string{})
+	input.Rating = a.readString(qs, "rating", "")
+	input.ReleasedAfter = a.readDate(qs, "released_after", v)
+	input.ReleasedBefore = a.readDate(qs, "released_before", v)
 	input.Filters.Page = a.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = a.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = a.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafeList = movieSortSafeList
 
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	if validateMovieListInput(v, &input); !v.Valid() {
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := a.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := a.modelsFor(r).Movies.GetAll(r.Context(), input.Title, input.Genres, input.Rating, input.ReleasedAfter, input.ReleasedBefore, input.Filters)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = a.writeJson(w, http.StatusOK, envelop{"movies": movies, "metadata": metadata}, nil)
+	// The list has no single version to derive an ETag from, so it is tagged with a hash
+	// of the response body instead.
+	err = a.writeJSONWithETag(w, r, envelop{"movies": movies, "metadata": metadata}, "")
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// conflictingMovies simulates another client updating every movie between our read and write.
+type conflictingMovies struct {
+	data.MovieStore
+}
+
+func (conflictingMovies) Update(ctx context.Context, movie *data.Movie) error {
+	return data.ErrEditConflict
+}
+
+func (conflictingMovies) Delete(ctx context.Context, id int64, version int32) error {
+	if version == 0 {
+		return nil
+	}
+	return data.ErrEditConflict
+}
+
+func seedMovies(t *testing.T, app *application) {
+	t.Helper()
+
+	releaseDate := func(s string) data.Date {
+		d, err := data.ParseDate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	insertMovie(t, app, &data.Movie{Title: "Moana", Year: 2016, RunTime: 107, Genres: []string{"animation", "adventure"}, Rating: "PG", ReleaseDate: releaseDate("2016-11-23"), OriginalLanguage: "en"})
+	insertMovie(t, app, &data.Movie{Title: "Black Panther", Year: 2018, RunTime: 134, Genres: []string{"action", "adventure"}, Rating: "PG-13", ReleaseDate: releaseDate("2018-02-16"), OriginalLanguage: "en"})
+	insertMovie(t, app, &data.Movie{Title: "The Breakfast Club", Year: 1985, RunTime: 97, Genres: []string{"comedy", "drama"}, Rating: "R", ReleaseDate: releaseDate("1985-02-15"), Synopsis: "Five students meet in Saturday detention."})
+}
+
+func TestCreateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	activated := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	inactive := authToken(t, app, insertUser(t, app, "Bob", "bob@example.com", false))
+
+	tests := []struct {
+		name     string
+		token    string
+		body     string
+		status   int
+		golden   bool
+		location string
+	}{
+		{
+			name:     "Valid",
+			token:    activated,
+			body:     `{"title": "Moana", "year": 2016, "run_time": "107 mins", "genres": ["animation", "adventure"], "rating": "PG", "release_date": "2016-11-23", "original_language": "en", "synopsis": "A voyage across the ocean."}`,
+			status:   http.StatusCreated,
+			golden:   true,
+			location: "/v1/movies/1",
+		},
+		{
+			name:   "FailedValidation",
+			token:  activated,
+			body:   `{"title": "", "year": 1500, "run_time": "-5 mins", "genres": ["drama", "drama"], "rating": "X", "release_date": "1700-01-01", "original_language": "english"}`,
+			status: http.StatusUnprocessableEntity,
+			golden: true,
+		},
+		{
+			name:   "BadlyFormedJSON",
+			token:  activated,
+			body:   `{"title": "Moana",`,
+			status: http.StatusBadRequest,
+			golden: true,
+		},
+		{
+			name:   "UnknownField",
+			token:  activated,
+			body:   `{"title": "Moana", "director": "Ron Clements"}`,
+			status: http.StatusBadRequest,
+			golden: true,
+		},
+		{
+			name:   "InvalidRuntime",
+			token:  activated,
+			body:   `{"title": "Moana", "run_time": 107}`,
+			status: http.StatusBadRequest,
+			golden: true,
+		},
+		{
+			name:   "Anonymous",
+			body:   `{"title": "Moana"}`,
+			status: http.StatusUnauthorized,
+			golden: true,
+		},
+		{
+			name:   "InactiveUser",
+			token:  inactive,
+			body:   `{"title": "Moana"}`,
+			status: http.StatusForbidden,
+			golden: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/movies", tt.token, tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			if tt.golden {
+				assertGolden(t, res)
+			}
+			if got := res.header.Get("Location"); got != tt.location {
+				t.Errorf("got Location %q; want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestShowMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"Valid", "/v1/movies/2", http.StatusOK},
+		{"NotFound", "/v1/movies/42", http.StatusNotFound},
+		{"NegativeID", "/v1/movies/-1", http.StatusNotFound},
+		{"InvalidID", "/v1/movies/foo", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, token, "", nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+}
+
+func TestUpdateMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"Valid", "/v1/movies/1", `{"year": 2017, "run_time": "108 mins", "rating": "G", "synopsis": "Updated."}`, http.StatusOK},
+		{"FailedValidation", "/v1/movies/1", `{"year": 3000, "genres": []}`, http.StatusUnprocessableEntity},
+		{"BadlyFormedJSON", "/v1/movies/1", `{"year": `, http.StatusBadRequest},
+		{"NotFound", "/v1/movies/42", `{"year": 2017}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPatch, tt.path, token, tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+
+	t.Run("EditConflict", func(t *testing.T) {
+		app := newTestApplication(t)
+		token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+		seedMovies(t, app)
+		app.models.Movies = conflictingMovies{MovieStore: app.models.Movies}
+		ts := newTestServer(t, app)
+
+		res := ts.do(t, http.MethodPatch, "/v1/movies/2", token, `{"year": 2019}`, nil)
+
+		assertStatus(t, res, http.StatusConflict)
+		assertGolden(t, res)
+	})
+}
+
+func TestDeleteMovie(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	res := ts.do(t, http.MethodDelete, "/v1/movies/3", token, "", nil)
+	assertStatus(t, res, http.StatusOK)
+	assertGolden(t, res)
+
+	res = ts.do(t, http.MethodDelete, "/v1/movies/3", token, "", nil)
+	assertStatus(t, res, http.StatusNotFound)
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/3", token, "", nil)
+	assertStatus(t, res, http.StatusNotFound)
+}
+
+func TestListMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"All", "", http.StatusOK},
+		{"Title", "?title=panther", http.StatusOK},
+		{"Genres", "?genres=adventure", http.StatusOK},
+		{"Rating", "?rating=R", http.StatusOK},
+		{"ReleaseDateRange", "?released_after=2016-01-01&released_before=2017-01-01", http.StatusOK},
+		{"SortedPage", "?sort=-year&page=2&page_size=1", http.StatusOK},
+		{"SortedByReleaseDate", "?sort=release_date", http.StatusOK},
+		{"NoResults", "?title=nothing", http.StatusOK},
+		{"InvalidFilters", "?page=0&page_size=101&sort=director&rating=X&released_after=yesterday", http.StatusUnprocessableEntity},
+		{"InvalidDateRange", "?released_after=2018-01-01&released_before=2017-01-01", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, "", nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	for _, path := range []string{"/v1/movies/2", "/v1/movies?genres=adventure"} {
+		t.Run(path, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, path, token, "", nil)
+			assertStatus(t, res, http.StatusOK)
+
+			etag := res.header.Get("ETag")
+			if !strings.HasPrefix(etag, `"`) {
+				t.Fatalf("got ETag %q; want a strong entity tag", etag)
+			}
+
+			res = ts.do(t, http.MethodGet, path, token, "", map[string]string{"If-None-Match": `"stale", ` + etag})
+			assertStatus(t, res, http.StatusNotModified)
+			if len(res.body) != 0 {
+				t.Errorf("got body %q; want none", res.body)
+			}
+			if got := res.header.Get("ETag"); got != etag {
+				t.Errorf("got ETag %q; want %q", got, etag)
+			}
+
+			res = ts.do(t, http.MethodGet, path, token, "", map[string]string{"If-None-Match": `"stale"`})
+			assertStatus(t, res, http.StatusOK)
+
+			// Changing the movie changes the tag of both its own and the list's representation.
+			ts.do(t, http.MethodPatch, "/v1/movies/2", token, `{"year": 2019}`, nil)
+
+			res = ts.do(t, http.MethodGet, path, token, "", map[string]string{"If-None-Match": etag})
+			assertStatus(t, res, http.StatusOK)
+			if got := res.header.Get("ETag"); got == etag {
+				t.Errorf("ETag %q did not change after the movie was updated", got)
+			}
+		})
+	}
+}
+
+func TestMovieCache(t *testing.T) {
+	app := newTestApplication(t)
+	cache := data.NewMovieCache(10, time.Minute)
+	app.models = cache.Wrap(app.models)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+	seedMovies(t, app)
+
+	assertCounts := func(t *testing.T, hits, misses int64) {
+		t.Helper()
+
+		stats := cache.Stats()
+		if stats["hits"] != hits || stats["misses"] != misses {
+			t.Errorf("got %d hits and %d misses; want %d and %d", stats["hits"], stats["misses"], hits, misses)
+		}
+	}
+
+	ts.do(t, http.MethodGet, "/v1/movies/1", token, "", nil)
+	ts.do(t, http.MethodGet, "/v1/movies", token, "", nil)
+	assertCounts(t, 0, 2)
+
+	ts.do(t, http.MethodGet, "/v1/movies/1", token, "", nil)
+	ts.do(t, http.MethodGet, "/v1/movies", token, "", nil)
+	assertCounts(t, 2, 2)
+
+	res := ts.do(t, http.MethodPatch, "/v1/movies/1", token, `{"year": 2017}`, nil)
+	assertStatus(t, res, http.StatusOK)
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/1", token, "", nil)
+	if !strings.Contains(string(res.body), `"year": 2017`) {
+		t.Errorf("got stale movie after update: %s", res.body)
+	}
+	ts.do(t, http.MethodGet, "/v1/movies", token, "", nil)
+	assertCounts(t, 2, 4)
+
+	ts.do(t, http.MethodDelete, "/v1/movies/1", token, "", nil)
+	res = ts.do(t, http.MethodGet, "/v1/movies/1", token, "", nil)
+	assertStatus(t, res, http.StatusNotFound)
+
+	insertMovie(t, app, &data.Movie{Title: "Up", Year: 2009, RunTime: 96, Genres: []string{"animation"}})
+	res = ts.do(t, http.MethodGet, "/v1/movies", token, "", nil)
+	if !strings.Contains(string(res.body), `"title": "Up"`) {
+		t.Errorf("got stale list after insert: %s", res.body)
+	}
+}
+
+func TestMoviePreconditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+		golden  bool
+	}{
+		{"UpdateIfMatch", http.MethodPatch, map[string]string{"If-Match": `"2-1"`}, http.StatusOK, false},
+		{"UpdateIfMatchAny", http.MethodPatch, map[string]string{"If-Match": `*`}, http.StatusOK, false},
+		{"UpdateIfMatchList", http.MethodPatch, map[string]string{"If-Match": `"2-0", "2-1"`}, http.StatusOK, false},
+		{"UpdateStaleIfMatch", http.MethodPatch, map[string]string{"If-Match": `"2-0"`}, http.StatusPreconditionFailed, true},
+		{"UpdateWeakIfMatch", http.MethodPatch, map[string]string{"If-Match": `W/"2-1"`}, http.StatusPreconditionFailed, false},
+		{"UpdateExpectedVersion", http.MethodPatch, map[string]string{"X-Expected-Version": "1"}, http.StatusOK, false},
+		{"UpdateStaleExpectedVersion", http.MethodPatch, map[string]string{"X-Expected-Version": "2"}, http.StatusPreconditionFailed, false},
+		{"UpdateInvalidExpectedVersion", http.MethodPatch, map[string]string{"X-Expected-Version": "one"}, http.StatusBadRequest, true},
+		{"DeleteIfMatch", http.MethodDelete, map[string]string{"If-Match": `"2-1"`}, http.StatusOK, false},
+		{"DeleteStaleIfMatch", http.MethodDelete, map[string]string{"If-Match": `"2-0"`}, http.StatusPreconditionFailed, false},
+		{"DeleteExpectedVersion", http.MethodDelete, map[string]string{"X-Expected-Version": "1"}, http.StatusOK, false},
+		{"DeleteStaleExpectedVersion", http.MethodDelete, map[string]string{"X-Expected-Version": "3"}, http.StatusPreconditionFailed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+			seedMovies(t, app)
+
+			body := ""
+			if tt.method == http.MethodPatch {
+				body = `{"year": 2019}`
+			}
+
+			res := ts.do(t, tt.method, "/v1/movies/2", token, body, tt.headers)
+
+			assertStatus(t, res, tt.status)
+			if tt.golden {
+				assertGolden(t, res)
+			}
+		})
+	}
+
+	// The movie matched the precondition when it was loaded, but changed before the write.
+	t.Run("UpdateChangedConcurrently", func(t *testing.T) {
+		app := newTestApplication(t)
+		token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+		seedMovies(t, app)
+		app.models.Movies = conflictingMovies{MovieStore: app.models.Movies}
+		ts := newTestServer(t, app)
+
+		res := ts.do(t, http.MethodPatch, "/v1/movies/2", token, `{"year": 2019}`, map[string]string{"If-Match": `"2-1"`})
+
+		assertStatus(t, res, http.StatusPreconditionFailed)
+	})
+
+	t.Run("DeleteChangedConcurrently", func(t *testing.T) {
+		app := newTestApplication(t)
+		token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+		seedMovies(t, app)
+		app.models.Movies = conflictingMovies{MovieStore: app.models.Movies}
+		ts := newTestServer(t, app)
+
+		res := ts.do(t, http.MethodDelete, "/v1/movies/2", token, "", map[string]string{"X-Expected-Version": "1"})
+
+		assertStatus(t, res, http.StatusPreconditionFailed)
+	})
+}
+
+func TestPatchMovie(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"MergePatchTitle", mergePatchMediaType, `{"title": "Black Panther: Wakanda Forever"}`, http.StatusOK},
+		{"MergePatchClearFields", mergePatchMediaType, `{"rating": null, "release_date": null, "original_language": null}`, http.StatusOK},
+		{"MergePatchClearRequiredField", mergePatchMediaType, `{"genres": null}`, http.StatusUnprocessableEntity},
+		{"MergePatchUnknownField", mergePatchMediaType, `{"director": "Ryan Coogler"}`, http.StatusBadRequest},
+		{"PlainJSON", "application/json; charset=utf-8", `{"title": "Black Panther: Wakanda Forever"}`, http.StatusOK},
+		{"JSONPatch", jsonPatchMediaType, `[{"op": "test", "path": "/year", "value": 2018}, {"op": "replace", "path": "/title", "value": "Black Panther: Wakanda Forever"}, {"op": "add", "path": "/genres/-", "value": "sci-fi"}, {"op": "remove", "path": "/rating"}]`, http.StatusOK},
+		{"JSONPatchTestFailed", jsonPatchMediaType, `[{"op": "test", "path": "/year", "value": 1999}, {"op": "replace", "path": "/year", "value": 2019}]`, http.StatusConflict},
+		{"JSONPatchMissingPath", jsonPatchMediaType, `[{"op": "replace", "path": "/genres/5", "value": "drama"}]`, http.StatusConflict},
+		{"JSONPatchUnknownField", jsonPatchMediaType, `[{"op": "add", "path": "/director", "value": "Ryan Coogler"}]`, http.StatusBadRequest},
+		{"JSONPatchNotAnArray", jsonPatchMediaType, `{"op": "replace", "path": "/year", "value": 2019}`, http.StatusBadRequest},
+		{"UnsupportedMediaType", "text/plain", `year=2019`, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+			seedMovies(t, app)
+
+			res := ts.do(t, http.MethodPatch, "/v1/movies/2", token, tt.body, map[string]string{"Content-Type": tt.contentType})
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+
+			if tt.status == http.StatusUnsupportedMediaType {
+				if got := res.header.Get("Accept-Patch"); got != mergePatchMediaType+", "+jsonPatchMediaType {
+					t.Errorf("got Accept-Patch %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed docs/index.html
+var apiDocsPage []byte
+
+// routeAccess describes who can call a route.
+type routeAccess int
+
+const (
+	// accessOpen routes don't look at the Authorization header at all.
+	accessOpen routeAccess = iota
+	// accessOptional routes run authenticate, so a token is optional but must be valid.
+	accessOptional
+	// accessActivated routes require the token of an activated user.
+	accessActivated
+)
+
+// routeDoc documents a route in the OpenAPI document. The responses every route of its kind
+// can return, such as a 429 from the rate limiter or a 404 for an unknown ID, are added by
+// openAPIDocument, so responses only lists those particular to the route.
+type routeDoc struct {
+	summary     string
+	description string
+	tag         string
+	access      routeAccess
+	rateLimited bool
+	parameters  []openAPIParameter
+	body        *openAPIRequestBody
+	responses   map[int]openAPIResponse
+}
+
+type jsonSchema map[string]any
+
+type openAPIParameter struct {
+	Name        string     `json:"name"`
+	In          string     `json:"in"`
+	Description string     `json:"description,omitempty"`
+	Required    bool       `json:"required,omitempty"`
+	Schema      jsonSchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Description string                      `json:"description,omitempty"`
+	Required    bool                        `json:"required"`
+	Content     map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIHeader struct {
+	Description string     `json:"description,omitempty"`
+	Schema      jsonSchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref         string                      `json:"$ref,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Headers     map[string]openAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+func schemaRef(name string) jsonSchema {
+	return jsonSchema{"$ref": "#/components/schemas/" + name}
+}
+
+// envelopeSchema describes a response wrapped in an envelop, such as envelop{"movie": movie}.
+func envelopeSchema(properties map[string]jsonSchema) jsonSchema {
+	required := make([]string, 0, len(properties))
+	for name := range properties {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+
+	return jsonSchema{"type": "object", "properties": properties, "required": required, "additionalProperties": false}
+}
+
+func jsonBody(description string, schema jsonSchema) *openAPIRequestBody {
+	return &openAPIRequestBody{
+		Description: description,
+		Required:    true,
+		Content:     map[string]openAPIMediaType{"application/json": {Schema: schema}},
+	}
+}
+
+func jsonResponse(description string, schema jsonSchema) openAPIResponse {
+	return openAPIResponse{
+		Description: description,
+		Content:     map[string]openAPIMediaType{"application/json": {Schema: schema}},
+	}
+}
+
+// errorJSONResponse documents an error response, which is sent as problem details to clients
+// which ask for them.
+func errorJSONResponse(description string, schema jsonSchema) openAPIResponse {
+	response := jsonResponse(description, schema)
+	response.Content[problemMediaType] = openAPIMediaType{Schema: schemaRef("Problem")}
+	return response
+}
+
+func responseRef(name string) openAPIResponse {
+	return openAPIResponse{Ref: "#/components/responses/" + name}
+}
+
+func queryParameter(name, description string, schema jsonSchema) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func headerParameter(name, description string, schema jsonSchema) openAPIParameter {
+	return openAPIParameter{Name: name, In: "header", Description: description, Schema: schema}
+}
+
+// withHeaders returns response with the given response headers added.
+func withHeaders(response openAPIResponse, headers map[string]openAPIHeader) openAPIResponse {
+	response.Headers = headers
+	return response
+}
+
+var (
+	etagHeader     = openAPIHeader{Description: "Strong entity tag of the representation", Schema: jsonSchema{"type": "string"}}
+	locationHeader = openAPIHeader{Description: "URL of the created resource", Schema: jsonSchema{"type": "string"}}
+
+	requestIDParameter       = headerParameter("X-Request-ID", "ID correlating the request with the server's logs, echoed in the response. One is generated unless this is 1 to 128 letters, digits or any of . _ : -", jsonSchema{"type": "string", "pattern": requestIDPattern.String()})
+	traceparentParameter     = headerParameter("traceparent", "W3C Trace Context of the caller, whose trace the request's spans join. A new trace is started when it is missing or malformed", jsonSchema{"type": "string", "pattern": "^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}"})
+	idempotencyKeyParameter  = headerParameter("Idempotency-Key", "Unique key, such as a UUID, which makes retrying the request safe. The response to the first request with a key is replayed for later requests with the same key and body.", jsonSchema{"type": "string", "maxLength": 255})
+	ifMatchParameter         = headerParameter("If-Match", "Only apply the change if the movie still has this ETag", jsonSchema{"type": "string"})
+	ifNoneMatchParameter     = headerParameter("If-None-Match", "Respond with 304 Not Modified if the representation still has this ETag", jsonSchema{"type": "string"})
+	expectedVersionParameter = headerParameter("X-Expected-Version", "Only apply the change if the movie is still at this version", jsonSchema{"type": "integer", "minimum": 1})
+	notModifiedResponse      = openAPIResponse{Description: "The representation still matches If-None-Match"}
+)
+
+// schemaTypes are the types with their own JSON encoding, described by a shared schema.
+var schemaTypes = map[reflect.Type]string{
+	reflect.TypeOf(data.Runtime(0)): "Runtime",
+	reflect.TypeOf(data.Date{}):     "Date",
+}
+
+// schemaFor returns a JSON Schema for the JSON encoding of values of type t, following
+// the json tags of struct fields.
+func schemaFor(t reflect.Type) jsonSchema {
+	if name, ok := schemaTypes[t]; ok {
+		return schemaRef(name)
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return jsonSchema{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int32:
+		return jsonSchema{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64:
+		return jsonSchema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice:
+		return jsonSchema{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]jsonSchema)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+		}
+		return jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+
+	return jsonSchema{}
+}
+
+// withProperty returns schema with the schema of one of its properties extended.
+func withProperty(schema jsonSchema, name string, extra jsonSchema) jsonSchema {
+	property := schema["properties"].(map[string]jsonSchema)[name]
+	for key, value := range extra {
+		property[key] = value
+	}
+	return schema
+}
+
+func withRequired(schema jsonSchema, required ...string) jsonSchema {
+	schema["required"] = required
+	return schema
+}
+
+// readinessSchema describes the response of the readiness check with the given status.
+func readinessSchema(status string) jsonSchema {
+	component := jsonSchema{
+		"type": "object",
+		"properties": map[string]jsonSchema{
+			"status":     {"type": "string", "enum": []string{"up", "down"}},
+			"latency_ms": {"type": "number"},
+			"error":      {"type": "string"},
+			"version":    {"type": "integer"},
+			"latest":     {"type": "integer"},
+		},
+		"required":             []string{"latency_ms", "status"},
+		"additionalProperties": false,
+	}
+
+	return envelopeSchema(map[string]jsonSchema{
+		"status":     {"type": "string", "const": status},
+		"components": {"type": "object", "additionalProperties": component},
+	})
+}
+
+func errorSchema(message jsonSchema) jsonSchema {
+	schema := envelopeSchema(map[string]jsonSchema{"error": message})
+	schema["properties"].(map[string]jsonSchema)["request_id"] = jsonSchema{"type": "string", "description": "X-Request-ID of the request"}
+	return schema
+}
+
+// openAPIComponents returns the schemas, responses and security schemes shared by the
+// operations of the OpenAPI document.
+func openAPIComponents() map[string]any {
+	schemas := map[string]jsonSchema{
+		"Movie": withProperty(schemaFor(reflect.TypeOf(data.Movie{})), "rating", jsonSchema{"enum": data.Ratings}),
+		"MovieInput": withProperty(withProperty(schemaFor(reflect.TypeOf(movieInput{})),
+			"rating", jsonSchema{"enum": data.Ratings}),
+			"original_language", jsonSchema{"pattern": data.LanguageRX.String()}),
+		"Metadata":            schemaFor(reflect.TypeOf(data.Metadata{})),
+		"User":                schemaFor(reflect.TypeOf(data.User{})),
+		"AuthenticationToken": schemaFor(reflect.TypeOf(data.Token{})),
+		"Runtime": {
+			"type":        "string",
+			"description": "Running time in minutes, formatted as \"<minutes> mins\"",
+			"pattern":     `^[0-9]+ mins$`,
+			"examples":    []string{"102 mins"},
+		},
+		"Date": {
+			"type":        []string{"string", "null"},
+			"format":      "date",
+			"description": "Calendar date in YYYY-MM-DD format, or null if unknown",
+		},
+		"JSONPatch": {
+			"type":        "array",
+			"description": "RFC 6902 JSON Patch document",
+			"items": jsonSchema{
+				"type": "object",
+				"properties": map[string]jsonSchema{
+					"op":    {"enum": []string{"add", "remove", "replace", "move", "copy", "test"}},
+					"path":  {"type": "string"},
+					"from":  {"type": "string"},
+					"value": {},
+				},
+				"required": []string{"op", "path"},
+			},
+		},
+		"Error":           errorSchema(jsonSchema{"type": "string"}),
+		"ValidationError": errorSchema(jsonSchema{"type": "object", "additionalProperties": jsonSchema{"type": "string"}, "description": "Validation error messages keyed by field"}),
+		"Problem": withRequired(withProperty(schemaFor(reflect.TypeOf(problem{})), "type", jsonSchema{
+			"format":      "uri",
+			"description": "RFC 9457 problem type, sent with Accept: application/problem+json or when the server runs with -problem-json. It is about:blank unless the server runs with -problem-type-base, and code identifies the error either way",
+		}), "type", "title", "status", "detail", "instance", "code"),
+	}
+
+	errorResponse := func(description string) openAPIResponse {
+		return errorJSONResponse(description, schemaRef("Error"))
+	}
+
+	responses := map[string]openAPIResponse{
+		"BadRequest":           errorResponse("The request body is not valid JSON or doesn't match the input"),
+		"FailedValidation":     errorJSONResponse("The input failed validation", schemaRef("ValidationError")),
+		"InvalidToken":         withHeaders(errorResponse("The authentication token is invalid or has expired"), map[string]openAPIHeader{"WWW-Authenticate": {Schema: jsonSchema{"const": "Bearer"}}}),
+		"AuthenticationNeeded": errorResponse("The request has no authentication token, or an invalid one"),
+		"InactiveAccount":      errorResponse("The user account hasn't been activated"),
+		"NotFound":             errorResponse("The requested resource could not be found"),
+		"EditConflict":         errorResponse("The record was changed by another request, please try again"),
+		"PreconditionFailed":   errorResponse("The record has been modified since the version given in If-Match or X-Expected-Version"),
+		"IdempotencyConflict":  withHeaders(errorResponse("A request with the same Idempotency-Key is still being processed"), map[string]openAPIHeader{"Retry-After": {Schema: jsonSchema{"type": "integer"}}}),
+		"RateLimitExceeded":    errorResponse("Too many requests from the client's IP address"),
+		"ServerError":          errorResponse("The server encountered a problem, or timed out"),
+	}
+
+	return map[string]any{
+		"schemas":   schemas,
+		"responses": responses,
+		"securitySchemes": map[string]any{
+			"bearerAuth": map[string]any{
+				"type":        "http",
+				"scheme":      "bearer",
+				"description": "Authentication token issued by POST /v1/tokens/authentication",
+			},
+		},
+	}
+}
+
+// openAPIPath converts an httprouter path such as /v1/movies/:id to the OpenAPI form
+// /v1/movies/{id}, returning its path parameters.
+func openAPIPath(path string) (string, []openAPIParameter) {
+	var parameters []openAPIParameter
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := strings.TrimPrefix(segment, ":")
+			segments[i] = "{" + name + "}"
+			parameters = append(parameters, openAPIParameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   jsonSchema{"type": "integer", "format": "int64", "minimum": 1},
+			})
+		}
+	}
+
+	return strings.Join(segments, "/"), parameters
+}
+
+// openAPIOperationID derives an operation ID such as getV1MoviesId from a route.
+func openAPIOperationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return !('a' <= r && r <= 'z' || '0' <= r && r <= '9') }) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// openAPIDocument returns the OpenAPI 3.1 document describing routes.
+func openAPIDocument(routes []route) map[string]any {
+	paths := make(map[string]map[string]openAPIOperation)
+
+	for _, rt := range routes {
+		path, parameters := openAPIPath(rt.path)
+		doc := rt.doc
+
+		op := openAPIOperation{
+			Summary:     doc.summary,
+			Description: doc.description,
+			OperationID: openAPIOperationID(rt.method, rt.path),
+			Parameters:  append(append(parameters, doc.parameters...), requestIDParameter, traceparentParameter),
+			RequestBody: doc.body,
+			Responses:   make(map[string]openAPIResponse),
+		}
+		if doc.tag != "" {
+			op.Tags = []string{doc.tag}
+		}
+
+		switch doc.access {
+		case accessOptional:
+			op.Security = []map[string][]string{{}, {"bearerAuth": {}}}
+			op.Responses["401"] = responseRef("InvalidToken")
+		case accessActivated:
+			op.Security = []map[string][]string{{"bearerAuth": {}}}
+			op.Responses["401"] = responseRef("AuthenticationNeeded")
+			op.Responses["403"] = responseRef("InactiveAccount")
+		}
+		if len(parameters) > 0 {
+			op.Responses["404"] = responseRef("NotFound")
+		}
+		if doc.body != nil {
+			op.Responses["400"] = responseRef("BadRequest")
+		}
+		if doc.rateLimited {
+			op.Responses["429"] = responseRef("RateLimitExceeded")
+		}
+		op.Responses["500"] = responseRef("ServerError")
+
+		for status, response := range doc.responses {
+			op.Responses[strconv.Itoa(status)] = response
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]openAPIOperation)
+		}
+		paths[path][strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "Greenlight API",
+			"version":     version,
+			"description": "JSON API for retrieving and managing information about movies.",
+		},
+		"paths":      paths,
+		"components": openAPIComponents(),
+	}
+}
+
+// openAPIHandler serves the OpenAPI document. The document is built on the first request,
+// rather than when the routes are registered, as it describes the route table this handler
+// is part of.
+func (a *application) openAPIHandler() http.HandlerFunc {
+	var (
+		once     sync.Once
+		document []byte
+		err      error
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			document, err = json.MarshalIndent(openAPIDocument(a.routeTable(nil)), "", "\t")
+		})
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}
+}
+
+// apiDocsHandler serves a page which renders the OpenAPI document, so the API can be
+// browsed without any third-party tooling.
+func (a *application) apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(apiDocsPage)
+}
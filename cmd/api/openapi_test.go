@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	res := ts.do(t, http.MethodGet, "/v1/openapi.json", "", "", nil)
+	assertStatus(t, res, http.StatusOK)
+
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components map[string]map[string]json.RawMessage `json:"components"`
+	}
+	if err := json.Unmarshal(res.body, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("got openapi %q; want 3.1.0", doc.OpenAPI)
+	}
+
+	// Every documented operation is served by the router.
+	router := app.router()
+	for path, methods := range doc.Paths {
+		for method := range methods {
+			routerPath := strings.ReplaceAll(path, "{id}", "1")
+			if handle, _, _ := router.Lookup(strings.ToUpper(method), routerPath); handle == nil {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+
+	// Every route is documented.
+	for _, rt := range app.routeTable(nil) {
+		path, _ := openAPIPath(rt.path)
+		if _, ok := doc.Paths[path][strings.ToLower(rt.method)]; !ok {
+			t.Errorf("%s %s is routed but not documented", rt.method, rt.path)
+		}
+	}
+
+	// Every reference points at a component.
+	var refs []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for key, value := range v {
+				if ref, ok := value.(string); ok && key == "$ref" {
+					refs = append(refs, ref)
+				}
+				walk(value)
+			}
+		case []any:
+			for _, value := range v {
+				walk(value)
+			}
+		}
+	}
+	var all any
+	if err := json.Unmarshal(res.body, &all); err != nil {
+		t.Fatal(err)
+	}
+	walk(all)
+
+	if len(refs) == 0 {
+		t.Fatal("got no references")
+	}
+	for _, ref := range refs {
+		parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+		if len(parts) != 2 || doc.Components[parts[0]][parts[1]] == nil {
+			t.Errorf("reference %s does not resolve", ref)
+		}
+	}
+}
+
+func TestAPIDocs(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	res := ts.do(t, http.MethodGet, "/v1/docs", "", "", nil)
+
+	assertStatus(t, res, http.StatusOK)
+	if got := res.header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q; want text/html; charset=utf-8", got)
+	}
+	if !strings.Contains(string(res.body), "/v1/openapi.json") {
+		t.Error("got a page which doesn't load /v1/openapi.json")
+	}
+}
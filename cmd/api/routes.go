@@ -1,31 +1,365 @@
 package main
 
 import (
-	"expvar"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
 
-func (a *application) routes() *httprouter.Router {
+// route is an endpoint of the API, along with the documentation of it served in the
+// OpenAPI document.
+type route struct {
+	method  string
+	path    string
+	handler http.Handler
+	doc     routeDoc
+}
+
+// routes returns the handler for every request to the API: the router, wrapped in the
+// middleware which runs before a route is matched.
+func (a *application) routes() http.Handler {
+	return a.requestID(a.traceRequests(a.accessLog(a.recordMetrics(a.router()))))
+}
+
+func (a *application) router() *httprouter.Router {
 	router := httprouter.New()
 
 	router.NotFound = http.HandlerFunc(a.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(a.methodNotAllowedResponse)
+	// httprouter answers OPTIONS requests itself, so CORS preflight requests never reach the
+	// per-route enableCORS middleware unless it also wraps the global OPTIONS handler.
+	router.GlobalOPTIONS = a.enableCORS(func(w http.ResponseWriter, r *http.Request) {})
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", a.enableCORS(a.rateLimit(a.authenticate(a.healthcheckHandler))))
-
-	router.HandlerFunc(http.MethodGet, "/v1/movies", a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.listMoviesHandler)))))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.createMovieHandler)))))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.showMovieHandler)))))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.updateMovieHandler)))))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.deleteMovieHandler)))))
-	router.HandlerFunc(http.MethodPost, "/v1/users", a.enableCORS(a.authenticate(a.registerUserHandler)))
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", a.enableCORS(a.authenticate(a.activateUserHandler)))
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", a.enableCORS(a.authenticate(a.createAuthenticationTokenHandler)))
-
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	for _, rt := range a.routeTable(router) {
+		rt := rt
+		router.HandlerFunc(rt.method, rt.path, func(w http.ResponseWriter, r *http.Request) {
+			rt.handler.ServeHTTP(w, a.contextSetRoute(r, rt))
+		})
+	}
 
 	router.PanicHandler = a.recoverPanic
 
 	return router
 }
+
+// routeTable returns every route of the API. Batch requests are dispatched through router.
+func (a *application) routeTable(router http.Handler) []route {
+	// The schema is fixed, so failing to build it is a programming error.
+	schema, err := a.graphqlSchema()
+	if err != nil {
+		panic(err)
+	}
+
+	movieResponse := func(description string) openAPIResponse {
+		return withHeaders(jsonResponse(description, envelopeSchema(map[string]jsonSchema{"movie": schemaRef("Movie")})), map[string]openAPIHeader{"ETag": etagHeader})
+	}
+	userResponse := func(description string) openAPIResponse {
+		return jsonResponse(description, envelopeSchema(map[string]jsonSchema{"user": schemaRef("User")}))
+	}
+
+	return []route{
+		{
+			method:  http.MethodGet,
+			path:    "/v1/healthcheck",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.healthcheckHandler))),
+			doc: routeDoc{
+				summary:     "Show the application's status and version",
+				tag:         "system",
+				access:      accessOptional,
+				rateLimited: true,
+				responses: map[int]openAPIResponse{
+					http.StatusOK: jsonResponse("The application is available", envelopeSchema(map[string]jsonSchema{
+						"status": {"type": "string"},
+						"system_info": envelopeSchema(map[string]jsonSchema{
+							"environment": {"type": "string"},
+							"version":     {"type": "string"},
+						}),
+					})),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/healthz/live",
+			handler: http.HandlerFunc(a.livenessHandler),
+			doc: routeDoc{
+				summary:     "Check the application is alive",
+				description: "For liveness probes. Dependencies aren't checked, and the endpoint is never rate limited.",
+				tag:         "system",
+				responses: map[int]openAPIResponse{
+					http.StatusOK: jsonResponse("The application is running", envelopeSchema(map[string]jsonSchema{
+						"status": {"type": "string", "const": "alive"},
+					})),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/healthz/ready",
+			handler: http.HandlerFunc(a.readinessHandler),
+			doc: routeDoc{
+				summary:     "Check the application is ready to serve requests",
+				description: "For readiness probes. Checks the database connection and schema version, the SMTP server when -healthz-check-smtp is set, and whether shutdown has begun. The endpoint is never rate limited.",
+				tag:         "system",
+				responses: map[int]openAPIResponse{
+					http.StatusOK:                 jsonResponse("Every component is up", readinessSchema("ready")),
+					http.StatusServiceUnavailable: jsonResponse("A component is down", readinessSchema("unavailable")),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/movies",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.validateRequest(a.listMoviesHandler))))),
+			doc: routeDoc{
+				summary:     "List movies",
+				description: "Returns a page of the movies matching every given filter.",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				parameters: []openAPIParameter{
+					queryParameter("title", "Match titles containing all of these words", jsonSchema{"type": "string"}),
+					queryParameter("genres", "Comma-separated genres which the movies must all have", jsonSchema{"type": "string"}),
+					queryParameter("rating", "Match movies with this rating", jsonSchema{"enum": data.Ratings}),
+					queryParameter("released_after", "Match movies released on or after this date", jsonSchema{"type": "string", "format": "date"}),
+					queryParameter("released_before", "Match movies released on or before this date", jsonSchema{"type": "string", "format": "date"}),
+					queryParameter("page", "Page number", jsonSchema{"type": "integer", "minimum": 1, "maximum": 10_000_000, "default": 1}),
+					queryParameter("page_size", "Number of movies per page", jsonSchema{"type": "integer", "minimum": 1, "maximum": 100, "default": 20}),
+					queryParameter("sort", "Field to sort by, in descending order when prefixed with -", jsonSchema{"enum": movieSortSafeList, "default": "id"}),
+					ifNoneMatchParameter,
+				},
+				responses: map[int]openAPIResponse{
+					http.StatusOK: withHeaders(jsonResponse("A page of movies", envelopeSchema(map[string]jsonSchema{
+						"movies":   {"type": "array", "items": schemaRef("Movie")},
+						"metadata": schemaRef("Metadata"),
+					})), map[string]openAPIHeader{"ETag": etagHeader}),
+					http.StatusNotModified:         notModifiedResponse,
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/movies",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.idempotent(a.validateRequest(a.createMovieHandler)))))),
+			doc: routeDoc{
+				summary:     "Create a movie",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				parameters:  []openAPIParameter{idempotencyKeyParameter},
+				body:        jsonBody("The new movie", withRequired(schemaRef("MovieInput"), "title", "year", "run_time", "genres")),
+				responses: map[int]openAPIResponse{
+					http.StatusCreated:  withHeaders(movieResponse("The created movie"), map[string]openAPIHeader{"ETag": etagHeader, "Location": locationHeader}),
+					http.StatusConflict: responseRef("IdempotencyConflict"),
+					http.StatusUnprocessableEntity: errorJSONResponse("The input failed validation, or the Idempotency-Key was already used for a different request", jsonSchema{
+						"oneOf": []jsonSchema{schemaRef("ValidationError"), schemaRef("Error")},
+					}),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/movies/:id",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.showMovieHandler)))),
+			doc: routeDoc{
+				summary:     "Show a movie",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				parameters:  []openAPIParameter{ifNoneMatchParameter},
+				responses: map[int]openAPIResponse{
+					http.StatusOK:          movieResponse("The movie"),
+					http.StatusNotModified: notModifiedResponse,
+				},
+			},
+		},
+		{
+			method:  http.MethodPatch,
+			path:    "/v1/movies/:id",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.validateRequest(a.updateMovieHandler))))),
+			doc: routeDoc{
+				summary:     "Update a movie",
+				description: "Applies a JSON Merge Patch or JSON Patch document to the editable fields of a movie. Bodies sent as application/json are treated as JSON Merge Patch documents.",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				parameters:  []openAPIParameter{ifMatchParameter, expectedVersionParameter},
+				body: &openAPIRequestBody{
+					Required: true,
+					Content: map[string]openAPIMediaType{
+						mergePatchMediaType: {Schema: schemaRef("MovieInput")},
+						jsonPatchMediaType:  {Schema: schemaRef("JSONPatch")},
+						"application/json":  {Schema: schemaRef("MovieInput")},
+					},
+				},
+				responses: map[int]openAPIResponse{
+					http.StatusOK:                   movieResponse("The updated movie"),
+					http.StatusConflict:             errorJSONResponse("The movie was changed by another request, or a JSON Patch operation failed", schemaRef("Error")),
+					http.StatusPreconditionFailed:   responseRef("PreconditionFailed"),
+					http.StatusUnsupportedMediaType: withHeaders(errorJSONResponse("The body isn't a supported patch document", schemaRef("Error")), map[string]openAPIHeader{"Accept-Patch": {Schema: jsonSchema{"type": "string"}}}),
+					http.StatusUnprocessableEntity:  responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/v1/movies/:id",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.deleteMovieHandler)))),
+			doc: routeDoc{
+				summary:     "Delete a movie",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				parameters:  []openAPIParameter{ifMatchParameter, expectedVersionParameter},
+				responses: map[int]openAPIResponse{
+					http.StatusOK:                 jsonResponse("The movie was deleted", envelopeSchema(map[string]jsonSchema{"message": {"type": "string"}})),
+					http.StatusPreconditionFailed: responseRef("PreconditionFailed"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/batch",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.requireActivatedUser(a.validateRequest(a.batchHandler(router)))))),
+			doc: routeDoc{
+				summary:     "Run several movie requests at once",
+				description: "Dispatches each request in order and returns their responses in the same order. An atomic batch runs in a single transaction, and stops and rolls back at the first request which fails.",
+				tag:         "movies",
+				access:      accessActivated,
+				rateLimited: true,
+				body: jsonBody("The requests to run", withRequired(envelopeSchema(map[string]jsonSchema{
+					"atomic": {"type": "boolean", "default": false},
+					"requests": {"type": "array", "minItems": 1, "items": withRequired(envelopeSchema(map[string]jsonSchema{
+						"method":  {"enum": []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete}},
+						"path":    {"type": "string", "pattern": "^/v1/movies([/?].*)?$"},
+						"headers": {"type": "object", "additionalProperties": jsonSchema{"type": "string"}},
+						"body":    {},
+					}), "method", "path")},
+				}), "requests")),
+				responses: map[int]openAPIResponse{
+					http.StatusOK: jsonResponse("The responses to the requests, and for an atomic batch whether its changes were committed", withRequired(envelopeSchema(map[string]jsonSchema{
+						"committed": {"type": "boolean"},
+						"responses": {"type": "array", "items": withRequired(envelopeSchema(map[string]jsonSchema{
+							"status":  {"type": "integer"},
+							"headers": {"type": "object", "additionalProperties": jsonSchema{"type": "string"}},
+							"body":    {},
+						}), "status", "body")},
+					}), "responses")),
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/graphql",
+			handler: a.enableCORS(a.rateLimit(a.authenticate(a.validateRequest(a.graphqlHandler(schema))))),
+			doc: routeDoc{
+				summary:     "Run a GraphQL query or mutation",
+				description: "Exposes the movie, movies and me queries and the createMovie, updateMovie, deleteMovie, registerUser, activateUser and createAuthenticationToken mutations. Errors raised while the operation runs are returned alongside the data with a 200 status.",
+				tag:         "graphql",
+				access:      accessOptional,
+				rateLimited: true,
+				body: jsonBody("The GraphQL request", withRequired(envelopeSchema(map[string]jsonSchema{
+					"query":         {"type": "string"},
+					"operationName": {"type": []string{"string", "null"}},
+					"variables":     {"type": []string{"object", "null"}},
+				}), "query")),
+				responses: map[int]openAPIResponse{
+					http.StatusOK: jsonResponse("The result of the operation", envelopeSchema(map[string]jsonSchema{
+						"data":   {"type": []string{"object", "null"}},
+						"errors": {"type": "array", "items": jsonSchema{"type": "object"}},
+					})),
+					http.StatusBadRequest: jsonResponse("The document doesn't parse, is invalid, or exceeds the depth or complexity limits", envelopeSchema(map[string]jsonSchema{
+						"errors": {"type": "array", "items": jsonSchema{"type": "object"}},
+					})),
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/users",
+			handler: a.enableCORS(a.authenticate(a.idempotent(a.validateRequest(a.registerUserHandler)))),
+			doc: routeDoc{
+				summary:     "Register a user",
+				description: "Creates an inactive user and emails them an activation token.",
+				tag:         "users",
+				access:      accessOptional,
+				parameters:  []openAPIParameter{idempotencyKeyParameter},
+				body: jsonBody("The new user", withRequired(envelopeSchema(map[string]jsonSchema{
+					"name":     {"type": "string", "maxLength": 500},
+					"email":    {"type": "string", "format": "email"},
+					"password": {"type": "string", "minLength": 8, "maxLength": 72},
+				}), "name", "email", "password")),
+				responses: map[int]openAPIResponse{
+					http.StatusCreated:             userResponse("The registered user"),
+					http.StatusConflict:            responseRef("IdempotencyConflict"),
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPut,
+			path:    "/v1/users/activated",
+			handler: a.enableCORS(a.authenticate(a.validateRequest(a.activateUserHandler))),
+			doc: routeDoc{
+				summary: "Activate a user",
+				tag:     "users",
+				access:  accessOptional,
+				body: jsonBody("The activation token emailed to the user", withRequired(envelopeSchema(map[string]jsonSchema{
+					"token": {"type": "string", "minLength": 26, "maxLength": 26},
+				}), "token")),
+				responses: map[int]openAPIResponse{
+					http.StatusOK:                  userResponse("The activated user"),
+					http.StatusConflict:            responseRef("EditConflict"),
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/tokens/authentication",
+			handler: a.enableCORS(a.authenticate(a.validateRequest(a.createAuthenticationTokenHandler))),
+			doc: routeDoc{
+				summary:     "Create an authentication token",
+				description: "Exchanges a user's email address and password for a token valid for 24 hours.",
+				tag:         "tokens",
+				access:      accessOptional,
+				body: jsonBody("The user's credentials", withRequired(envelopeSchema(map[string]jsonSchema{
+					"email":    {"type": "string", "format": "email"},
+					"password": {"type": "string", "minLength": 8, "maxLength": 72},
+				}), "email", "password")),
+				responses: map[int]openAPIResponse{
+					http.StatusCreated:             jsonResponse("The authentication token", envelopeSchema(map[string]jsonSchema{"authentication_token": schemaRef("AuthenticationToken")})),
+					http.StatusUnauthorized:        errorJSONResponse("The credentials are invalid, or the request's own token is", schemaRef("Error")),
+					http.StatusUnprocessableEntity: responseRef("FailedValidation"),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/openapi.json",
+			handler: a.enableCORS(a.openAPIHandler()),
+			doc: routeDoc{
+				summary: "Show this OpenAPI document",
+				tag:     "system",
+				responses: map[int]openAPIResponse{
+					http.StatusOK: jsonResponse("The OpenAPI document", jsonSchema{"type": "object"}),
+				},
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/docs",
+			handler: http.HandlerFunc(a.apiDocsHandler),
+			doc: routeDoc{
+				summary: "Browse the API documentation",
+				tag:     "system",
+				responses: map[int]openAPIResponse{
+					http.StatusOK: {Description: "An HTML page rendering the OpenAPI document", Content: map[string]openAPIMediaType{"text/html": {Schema: jsonSchema{"type": "string"}}}},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	t.Run("NotFound", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/nothing-here", "", "", nil)
+
+		assertStatus(t, res, http.StatusNotFound)
+		assertGolden(t, res)
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		res := ts.do(t, http.MethodPut, "/v1/healthcheck", "", "", nil)
+
+		assertStatus(t, res, http.StatusMethodNotAllowed)
+		assertGolden(t, res)
+		if got := res.header.Get("Allow"); !strings.Contains(got, http.MethodGet) {
+			t.Errorf("got Allow %q; want it to contain GET", got)
+		}
+	})
+
+	// Debug endpoints and metrics are only served by the admin listener.
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/metrics"} {
+		t.Run(path, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, path, "", "", nil)
+
+			assertStatus(t, res, http.StatusNotFound)
+		})
+	}
+}
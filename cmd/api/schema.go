@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaValidator checks JSON values against the schemas of the OpenAPI document, recording
+// each problem under the path of the field it was found in, such as requests[0].method.
+// It understands the subset of JSON Schema the document is written in.
+type schemaValidator struct {
+	*validator.Validator
+	schemas map[string]jsonSchema
+}
+
+func newSchemaValidator(schemas map[string]jsonSchema) schemaValidator {
+	return schemaValidator{Validator: validator.New(), schemas: schemas}
+}
+
+// fieldKey returns the key of the field name of the value at key.
+func fieldKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// fail records a problem with the value at key, where the empty key is the whole body.
+func (sv schemaValidator) fail(key, message string) {
+	if key == "" {
+		key = "body"
+	}
+	sv.AddError(key, message)
+}
+
+// check validates value, decoded with json.Decoder.UseNumber, against schema.
+func (sv schemaValidator) check(schema jsonSchema, value any, key string) {
+	// Keywords next to a $ref, such as the required fields of a request body, apply as well
+	// as those of the referenced schema.
+	if ref, ok := schema["$ref"].(string); ok {
+		sv.check(sv.schemas[strings.TrimPrefix(ref, "#/components/schemas/")], value, key)
+	}
+
+	if types := schemaList(schema["type"]); len(types) > 0 {
+		matched := false
+		for _, typ := range types {
+			matched = matched || matchesType(value, typ.(string))
+		}
+		if !matched {
+			sv.fail(key, typeMessage(types))
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"]; ok && !inEnum(value, schemaList(enum)) {
+		sv.fail(key, "must be one of "+listMessage(schemaList(enum)))
+		return
+	}
+	if constant, ok := schema["const"]; ok && !inEnum(value, []any{constant}) {
+		sv.fail(key, fmt.Sprintf("must be %v", constant))
+		return
+	}
+
+	if oneOf, ok := schema["oneOf"].([]jsonSchema); ok {
+		matches := 0
+		for _, option := range oneOf {
+			candidate := newSchemaValidator(sv.schemas)
+			if candidate.check(option, value, key); candidate.Valid() {
+				matches++
+			}
+		}
+		if matches != 1 {
+			sv.fail(key, "must match exactly one of the allowed schemas")
+			return
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		sv.checkString(schema, value, key)
+	case json.Number:
+		sv.checkNumber(schema, value, key)
+	case []any:
+		if minItems, ok := schema["minItems"].(int); ok && len(value) < minItems {
+			sv.fail(key, fmt.Sprintf("must contain at least %d %s", minItems, plural(minItems, "item")))
+		}
+		if items, ok := schema["items"].(jsonSchema); ok {
+			for i, item := range value {
+				sv.check(items, item, fmt.Sprintf("%s[%d]", key, i))
+			}
+		}
+	case map[string]any:
+		sv.checkObject(schema, value, key)
+	}
+}
+
+func (sv schemaValidator) checkString(schema jsonSchema, value, key string) {
+	length := utf8.RuneCountInString(value)
+	if minLength, ok := schema["minLength"].(int); ok && length < minLength {
+		sv.fail(key, fmt.Sprintf("must be at least %d %s long", minLength, plural(minLength, "character")))
+	}
+	if maxLength, ok := schema["maxLength"].(int); ok && length > maxLength {
+		sv.fail(key, fmt.Sprintf("must not be more than %d %s long", maxLength, plural(maxLength, "character")))
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if rx, err := regexp.Compile(pattern); err == nil && !rx.MatchString(value) {
+			sv.fail(key, "must match the pattern "+pattern)
+		}
+	}
+
+	switch schema["format"] {
+	case "date":
+		if _, err := data.ParseDate(value); err != nil {
+			sv.fail(key, "must be a date in YYYY-MM-DD format")
+		}
+	case "email":
+		if !validator.Matches(value, validator.EmailRX) {
+			sv.fail(key, "must be a valid email address")
+		}
+	}
+}
+
+func (sv schemaValidator) checkNumber(schema jsonSchema, value json.Number, key string) {
+	n, err := value.Float64()
+	if err != nil {
+		sv.fail(key, "must be a number")
+		return
+	}
+
+	if minimum, ok := schemaNumber(schema["minimum"]); ok && n < minimum {
+		sv.fail(key, fmt.Sprintf("must be a minimum of %v", schema["minimum"]))
+	}
+	if maximum, ok := schemaNumber(schema["maximum"]); ok && n > maximum {
+		sv.fail(key, fmt.Sprintf("must be a maximum of %v", schema["maximum"]))
+	}
+}
+
+func (sv schemaValidator) checkObject(schema jsonSchema, value map[string]any, key string) {
+	if required, ok := schema["required"].([]string); ok {
+		for _, name := range required {
+			if _, ok := value[name]; !ok {
+				sv.fail(fieldKey(key, name), "must be provided")
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]jsonSchema)
+	for name, field := range value {
+		if property, ok := properties[name]; ok {
+			sv.check(property, field, fieldKey(key, name))
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				sv.fail(fieldKey(key, name), "is not a known field")
+			}
+		case jsonSchema:
+			sv.check(additional, field, fieldKey(key, name))
+		}
+	}
+}
+
+// schemaList returns the values of a keyword which holds either a single value or a slice,
+// such as "type", as a []any.
+func schemaList(value any) []any {
+	if value == nil {
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return []any{value}
+	}
+
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list
+}
+
+func schemaNumber(value any) (float64, bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+func matchesType(value any, typ string) bool {
+	switch typ {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+// typeMessage returns a message such as "must be a string or null".
+func typeMessage(types []any) string {
+	names := make([]string, len(types))
+	for i, typ := range types {
+		switch typ {
+		case "null":
+			names[i] = "null"
+		case "array", "integer", "object":
+			names[i] = fmt.Sprintf("an %s", typ)
+		default:
+			names[i] = fmt.Sprintf("a %s", typ)
+		}
+	}
+	return "must be " + strings.Join(names, " or ")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return noun
+	}
+	return noun + "s"
+}
+
+// listMessage returns the values as a list such as "G, PG, PG-13, R or NC-17".
+func listMessage(values []any) string {
+	names := make([]string, len(values))
+	for i, value := range values {
+		names[i] = fmt.Sprint(value)
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func inEnum(value any, enum []any) bool {
+	for _, allowed := range enum {
+		switch value := value.(type) {
+		case string:
+			if allowed == value {
+				return true
+			}
+		case json.Number:
+			if _, isString := allowed.(string); !isString && fmt.Sprint(allowed) == value.String() {
+				return true
+			}
+		default:
+			if reflect.DeepEqual(allowed, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutNulls returns a JSON Merge Patch document without the members it removes, leaving
+// the values it sets to be checked against the schema of the resource.
+func withoutNulls(value any) any {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+
+	patch := make(map[string]any, len(object))
+	for name, field := range object {
+		if field != nil {
+			patch[name] = withoutNulls(field)
+		}
+	}
+	return patch
+}
+
+// requestMediaType returns the media type of body a request is sent as.
+func requestMediaType(body *openAPIRequestBody, contentType string) (string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if _, ok := body.Content[mediaType]; ok {
+		return mediaType, true
+	}
+
+	// Handlers accepting a single media type don't look at the Content-Type header, and
+	// readPatch treats a body without one as a JSON Merge Patch document.
+	if len(body.Content) == 1 {
+		for mediaType := range body.Content {
+			return mediaType, true
+		}
+	}
+	if _, ok := body.Content[mergePatchMediaType]; ok && mediaType == "" {
+		return mergePatchMediaType, true
+	}
+
+	return "", false
+}
+
+// validateRequest checks the query parameters and JSON body of a request against the
+// route's entry in the OpenAPI document before the handler runs, when -validate-requests is
+// set, so the published contract is enforced. Bodies which aren't JSON, or are sent as a
+// media type the route doesn't accept, are left for the handler to reject.
+func (a *application) validateRequest(next http.HandlerFunc) http.HandlerFunc {
+	schemas := openAPIComponents()["schemas"].(map[string]jsonSchema)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt, ok := a.contextGetRoute(r)
+		if !a.config.validateRequests || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sv := newSchemaValidator(schemas)
+
+		qs := r.URL.Query()
+		for _, parameter := range rt.doc.parameters {
+			if parameter.In != "query" || qs.Get(parameter.Name) == "" {
+				continue
+			}
+
+			var value any = qs.Get(parameter.Name)
+			if parameter.Schema["type"] == "integer" {
+				if !matchesType(json.Number(qs.Get(parameter.Name)), "integer") {
+					sv.AddError(parameter.Name, "must be an integer value")
+					continue
+				}
+				value = json.Number(qs.Get(parameter.Name))
+			}
+			sv.check(parameter.Schema, value, parameter.Name)
+		}
+
+		if body := rt.doc.body; body != nil {
+			raw, err := a.readBody(w, r)
+			if err != nil {
+				a.badRequestResponse(w, r, err)
+				return
+			}
+
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber()
+
+			// Bodies holding anything but a single JSON value are rejected by the handler.
+			var value any
+			mediaType, ok := requestMediaType(body, r.Header.Get("Content-Type"))
+			if ok && dec.Decode(&value) == nil && dec.Decode(&struct{}{}) == io.EOF {
+				if _, isPatch := body.Content[mergePatchMediaType]; isPatch && mediaType != jsonPatchMediaType {
+					value = withoutNulls(value)
+				}
+				sv.check(body.Content[mediaType].Schema, value, "")
+			}
+		}
+
+		if !sv.Valid() {
+			a.failedValidationResponse(w, r, sv.Errors)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
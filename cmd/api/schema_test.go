@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   bool
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{
+			name:   "QueryParameters",
+			method: http.MethodGet,
+			path:   "/v1/movies?page=abc&page_size=1000&rating=U&released_after=2016-02-30&sort=budget",
+			token:  true,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "BodyTypes",
+			method: http.MethodPost,
+			path:   "/v1/movies",
+			token:  true,
+			body:   `{"title": 42, "year": "2009", "run_time": 96, "genres": "animation", "director": "Pete Docter"}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "Valid",
+			method: http.MethodPost,
+			path:   "/v1/movies",
+			token:  true,
+			body:   `{"title": "Up", "year": 2009, "run_time": "96 mins", "genres": ["animation"], "release_date": null}`,
+			status: http.StatusCreated,
+		},
+		{
+			name:    "MergePatchRemovesFields",
+			method:  http.MethodPatch,
+			path:    "/v1/movies/2",
+			token:   true,
+			body:    `{"rating": null, "year": 2019}`,
+			headers: map[string]string{"Content-Type": mergePatchMediaType},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "JSONPatch",
+			method:  http.MethodPatch,
+			path:    "/v1/movies/2",
+			token:   true,
+			body:    `[{"op": "rename", "path": "/title"}, {"value": 2019}]`,
+			headers: map[string]string{"Content-Type": jsonPatchMediaType},
+			status:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "BatchNested",
+			method: http.MethodPost,
+			path:   "/v1/batch",
+			token:  true,
+			body:   `{"requests": [{"method": "GET", "path": "/v1/movies/1", "timeout": 5}, {"method": "GET", "path": "/v1/moviesx"}]}`,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "BatchSubRequest",
+			method: http.MethodPost,
+			path:   "/v1/batch",
+			token:  true,
+			body:   `{"requests": [{"method": "POST", "path": "/v1/movies", "body": {"title": "Up", "year": 2009.5}}]}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "MalformedJSON",
+			method: http.MethodPost,
+			path:   "/v1/tokens/authentication",
+			body:   `{"email": "alice@example.com",`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Anonymous",
+			method: http.MethodPost,
+			path:   "/v1/movies",
+			body:   `{"title": 42}`,
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.validateRequests = true
+			ts := newTestServer(t, app)
+			seedMovies(t, app)
+
+			var token string
+			if tt.token {
+				token = authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+			}
+
+			res := ts.do(t, tt.method, tt.path, token, tt.body, tt.headers)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+}
+
+func TestValidateRequestsDisabled(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	token := authToken(t, app, insertUser(t, app, "Alice", "alice@example.com", true))
+
+	// Without -validate-requests the handler's own decoding rejects the body.
+	res := ts.do(t, http.MethodPost, "/v1/movies", token, `{"title": 42}`, nil)
+
+	assertStatus(t, res, http.StatusBadRequest)
+	assertGolden(t, res)
+}
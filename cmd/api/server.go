@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"google.golang.org/grpc"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,6 +22,52 @@ func (a *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// The gRPC server listens before the HTTP server starts, so that a port which is already
+	// in use stops the application straight away.
+	var grpcSrv *grpc.Server
+	var grpcListener net.Listener
+	if a.config.grpc.port != 0 {
+		var err error
+		grpcListener, err = net.Listen("tcp", fmt.Sprintf(":%d", a.config.grpc.port))
+		if err != nil {
+			return err
+		}
+		grpcSrv = a.grpcServer()
+	}
+
+	// So does the admin listener, which is kept off the public port.
+	var adminSrv *http.Server
+	var adminListener net.Listener
+	if a.config.admin.addr != "" {
+		var err error
+		adminListener, err = net.Listen("tcp", a.config.admin.addr)
+		if err != nil {
+			return err
+		}
+		adminSrv = &http.Server{
+			Handler:     a.adminRoutes(),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 10 * time.Second,
+			// CPU profiles and execution traces take 30 seconds by default.
+			WriteTimeout: time.Minute,
+		}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go a.toggleDebugLogging(hangup)
+
+	// Expired idempotency keys are purged until shutdown begins, so that a purge never runs
+	// against a database which is being closed.
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	purgeStopped := make(chan struct{})
+	go func() {
+		defer close(purgeStopped)
+		a.purgeIdempotencyKeys(purgeCtx, time.Hour)
+	}()
+
 	// receive errors returned by the graceful shutdown() function
 	shutdownError := make(chan error)
 
@@ -33,32 +81,119 @@ func (a *application) serve() error {
 		// read the signal; block until we get signal
 		s := <-quite
 		// log message about the signal
-		a.logger.PrintInfo("caught signal", map[string]string{
+		a.logger.PrintInfo("caught signal", map[string]any{
 			"signal": s.String(),
 		})
+		a.shuttingDown.Store(true)
+		stopPurge()
+		<-purgeStopped
+
+		// Requests are still served while the readiness check reports the shutdown, unless a
+		// second signal asks to stop at once.
+		if delay := a.config.healthz.drainDelay; delay > 0 {
+			a.logger.PrintInfo("draining before shutdown", map[string]any{
+				"delay": delay.String(),
+			})
+			select {
+			case <-time.After(delay):
+			case <-quite:
+			}
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 
+		// The gRPC server drains its calls alongside the HTTP server, and any calls still
+		// running when the deadline is hit are cut off.
+		grpcStopped := make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			if grpcSrv == nil {
+				return
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				grpcSrv.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcSrv.Stop()
+			}
+		}()
+
+		// The admin listener shuts down alongside the HTTP server. Requests for profiles which
+		// are still running when the deadline is hit are cut off.
+		adminStopped := make(chan struct{})
+		go func() {
+			defer close(adminStopped)
+			if adminSrv == nil {
+				return
+			}
+
+			if err := adminSrv.Shutdown(ctx); err != nil {
+				adminSrv.Close()
+			}
+		}()
+
 		// will return nil if the graceful shutdown was successful
 		// or an error (which may happen because of a problem closing the listeners, or because the shutdown didn't complete before the 20-second context deadline is hit
 		err := srv.Shutdown(ctx)
+		<-grpcStopped
+		<-adminStopped
 		if err != nil {
 			shutdownError <- err
 		}
-		a.logger.PrintInfo("completing background tasks", map[string]string{
+		a.logger.PrintInfo("completing background tasks", map[string]any{
 			"addr": srv.Addr,
 		})
 		a.wg.Wait()
+
+		// The spans of background tasks end last, so queued spans are exported once they're
+		// done, within what is left of the deadline.
+		err = a.tracer.Shutdown(ctx)
+		if err != nil {
+			a.logger.Component("tracer").PrintError(err, nil)
+		}
 		shutdownError <- nil
 
 	}()
 
-	a.logger.PrintInfo("starting server", map[string]string{
+	a.logger.PrintInfo("starting server", map[string]any{
 		"addr": srv.Addr,
 		"env":  a.config.env,
 	})
 
+	if grpcSrv != nil {
+		a.logger.PrintInfo("starting grpc server", map[string]any{
+			"addr": grpcListener.Addr().String(),
+		})
+
+		go func() {
+			// Serve returns nil once the server is stopped during shutdown.
+			err := grpcSrv.Serve(grpcListener)
+			if err != nil {
+				a.logger.PrintError(err, nil)
+			}
+		}()
+	}
+
+	if adminSrv != nil {
+		a.logger.PrintInfo("starting admin server", map[string]any{
+			"addr": adminListener.Addr().String(),
+		})
+
+		go func() {
+			err := adminSrv.Serve(adminListener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				a.logger.Component("admin").PrintError(err, nil)
+			}
+		}()
+	}
+
 	// Calling Shutdown() on our server will cause ListenAndServe() to immediately return a http.ErrServerClosed error,
 	// So if we see this error, it is actually a good thing and an indication that the graceful shutdown has started.
 	err := srv.ListenAndServe()
@@ -74,7 +209,7 @@ func (a *application) serve() error {
 		return err
 	}
 
-	a.logger.PrintInfo("stopped server", map[string]string{
+	a.logger.PrintInfo("stopped server", map[string]any{
 		"addr": srv.Addr,
 	})
 
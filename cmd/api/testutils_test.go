@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/data/memory"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+const trustedOrigin = "https://trusted.example.com"
+
+func TestMain(m *testing.M) {
+	// Processes started by runMain run the application itself, with the arguments in
+	// GREENLIGHT_TEST_MAIN_ARGS, in place of the tests.
+	if args, ok := os.LookupEnv("GREENLIGHT_TEST_MAIN_ARGS"); ok {
+		os.Args = append([]string{"api"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+
+	data.PasswordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// runMain runs the application in a process of its own with args, returning its output.
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GREENLIGHT_TEST_MAIN_ARGS="+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// sentMail records a single call to mockMailer.Send.
+type sentMail struct {
+	recipient    string
+	templateFile string
+	data         map[string]any
+}
+
+// mockMailer captures outgoing emails instead of delivering them.
+type mockMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *mockMailer) Send(_ context.Context, recipient, templateFile string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, _ := data.(map[string]any)
+	m.sent = append(m.sent, sentMail{recipient: recipient, templateFile: templateFile, data: d})
+	return nil
+}
+
+func (m *mockMailer) messages() []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]sentMail(nil), m.sent...)
+}
+
+// newTestApplication returns an application backed by the in-memory models and a capturing
+// mailer, with rate limiting disabled and a single trusted CORS origin.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.cors.trustedOrigins = []string{trustedOrigin}
+	cfg.idempotency.ttl = time.Hour
+	cfg.batch.maxRequests = 5
+	cfg.graphql.maxDepth = 8
+	cfg.graphql.maxComplexity = 100
+
+	return &application{
+		config:  cfg,
+		logger:  jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:  memory.New(),
+		mailer:  &mockMailer{},
+		metrics: newMetrics(nil),
+	}
+}
+
+type testServer struct {
+	*httptest.Server
+	app *application
+}
+
+func newTestServer(t *testing.T, app *application) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+
+	return &testServer{Server: ts, app: app}
+}
+
+// newAdminTestServer serves the application's admin routes.
+func newAdminTestServer(t *testing.T, app *application) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(app.adminRoutes())
+	t.Cleanup(ts.Close)
+
+	return &testServer{Server: ts, app: app}
+}
+
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// do sends a request to the test server. An empty token sends no Authorization header.
+func (ts *testServer) do(t *testing.T, method, path, token, body string, headers map[string]string) testResponse {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for any background work, such as sending emails, started by the request.
+	ts.app.wg.Wait()
+
+	return testResponse{status: res.StatusCode, header: res.Header, body: b}
+}
+
+// insertUser stores a user directly through the models and returns it.
+func insertUser(t *testing.T, app *application, name, email string, activated bool) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: name, Email: email, Activated: activated}
+	if err := user.Password.Set(context.Background(), "pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// authToken returns a valid plaintext authentication token for the user.
+func authToken(t *testing.T, app *application, user *data.User) string {
+	t.Helper()
+
+	token, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Plaintext
+}
+
+// insertMovie stores a movie directly through the models and returns it.
+func insertMovie(t *testing.T, app *application, movie *data.Movie) *data.Movie {
+	t.Helper()
+
+	if err := app.models.Movies.Insert(context.Background(), movie); err != nil {
+		t.Fatal(err)
+	}
+
+	return movie
+}
+
+func assertStatus(t *testing.T, res testResponse, want int) {
+	t.Helper()
+
+	if res.status != want {
+		t.Errorf("got status %d; want %d; body: %s", res.status, want, res.body)
+	}
+}
+
+// volatileFields are replaced in response bodies before comparing them with golden files,
+// because their values change from one run to the next.
+var volatileFields = map[string]bool{
+	"created_at": true,
+	"createdAt":  true,
+	"expiry":     true,
+	"latency_ms": true,
+	"request_id": true,
+	"token":      true,
+}
+
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if volatileFields[key] {
+				v[key] = "<" + key + ">"
+				continue
+			}
+			v[key] = normalizeJSON(value)
+		}
+	case []any:
+		for i := range v {
+			v[i] = normalizeJSON(v[i])
+		}
+	}
+	return v
+}
+
+// assertGolden compares the JSON response body with testdata/<test name>.golden. Run the
+// tests with -update to rewrite the golden files from the current responses.
+func assertGolden(t *testing.T, res testResponse) {
+	t.Helper()
+
+	var v any
+	if err := json.Unmarshal(res.body, &v); err != nil {
+		t.Fatalf("response body is not valid JSON: %s: %s", err, res.body)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(normalizeJSON(v)); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.Bytes()
+
+	golden := filepath.Join("testdata", t.Name()+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %s", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("response body does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
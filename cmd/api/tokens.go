@@ -29,7 +29,7 @@ func (a *application) createAuthenticationTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	user, err := a.models.Users.GetByEmail(input.Email)
+	user, err := a.modelsFor(r).Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -40,7 +40,7 @@ func (a *application) createAuthenticationTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	match, err := user.Password.Matches(r.Context(), input.Password)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -51,7 +51,7 @@ func (a *application) createAuthenticationTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	token, err := a.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := a.modelsFor(r).Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
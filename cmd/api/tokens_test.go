@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCreateAuthenticationToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	insertUser(t, app, "Alice", "alice@example.com", true)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"Valid", `{"email": "alice@example.com", "password": "pa55word"}`, http.StatusCreated},
+		{"WrongPassword", `{"email": "alice@example.com", "password": "wrong-password"}`, http.StatusUnauthorized},
+		{"UnknownEmail", `{"email": "nobody@example.com", "password": "pa55word"}`, http.StatusUnauthorized},
+		{"FailedValidation", `{"email": "alice", "password": ""}`, http.StatusUnprocessableEntity},
+		{"WrongType", `{"email": 42, "password": "pa55word"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+
+	t.Run("TokenAuthenticates", func(t *testing.T) {
+		res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", `{"email": "alice@example.com", "password": "pa55word"}`, nil)
+		assertStatus(t, res, http.StatusCreated)
+
+		var body struct {
+			AuthenticationToken struct {
+				Token string `json:"token"`
+			} `json:"authentication_token"`
+		}
+		if err := json.Unmarshal(res.body, &body); err != nil {
+			t.Fatal(err)
+		}
+
+		res = ts.do(t, http.MethodGet, "/v1/movies", body.AuthenticationToken.Token, "", nil)
+		assertStatus(t, res, http.StatusOK)
+	})
+}
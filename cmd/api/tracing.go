@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/jsonlog"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// newTracer returns the tracer selected by the -trace-* flags, or nil when tracing is
+// disabled. Errors exporting spans are logged as warnings, as losing spans doesn't affect the
+// requests traced.
+func newTracer(cfg config, logger *jsonlog.Logger) (*trace.Tracer, error) {
+	var exporter trace.Exporter
+
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exporter = trace.NewWriterExporter(os.Stdout)
+	case "otlp":
+		exporter = trace.NewOTLPExporter(cfg.tracing.otlpEndpoint,
+			trace.String("service.name", "greenlight"),
+			trace.String("service.version", version),
+			trace.String("deployment.environment", cfg.env),
+		)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.tracing.exporter)
+	}
+
+	return trace.New(exporter, trace.Options{
+		SampleRate: cfg.tracing.sampleRate,
+		OnError: func(err error) {
+			logger.Component("tracer").PrintWarn(err.Error(), map[string]any{"exporter": cfg.tracing.exporter})
+		},
+	}), nil
+}
+
+// traceRequests records a server span for every request, continuing the caller's trace when
+// the request has a valid traceparent header. Like the request metrics, the span is named
+// after the pattern of the route the request matched rather than its path.
+func (a *application) traceRequests(next http.Handler) http.Handler {
+	if a.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _ := trace.ParseTraceparent(r.Header.Get("traceparent"))
+		ctx, span := a.tracer.Start(r.Context(), "HTTP "+r.Method, trace.KindServer, remote,
+			trace.String("http.request.method", r.Method),
+			trace.String("url.path", r.URL.Path),
+			trace.String("user_agent.original", r.UserAgent()),
+			trace.String("request_id", a.contextGetRequestID(r)),
+		)
+
+		r, info := a.contextSetRequestInfo(r.WithContext(ctx))
+		rw := &responseObserver{ResponseWriter: w}
+
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(trace.Int("http.response.status_code", status))
+
+			if info.route != "" {
+				span.SetName(r.Method + " " + info.route)
+				span.SetAttributes(trace.String("http.route", info.route))
+			}
+			if info.user != nil && !info.user.IsAnonymous() {
+				span.SetAttributes(trace.String("enduser.id", strconv.FormatInt(info.user.ID, 10)))
+			}
+			if status >= http.StatusInternalServerError {
+				span.RecordError(errors.New(http.StatusText(status)))
+			}
+
+			span.End()
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
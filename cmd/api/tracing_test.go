@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/mailer"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collectedSpan is a span as received by the collector stand-in, keeping only the fields the
+// tests look at.
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s collectedSpan) attribute(key string) any {
+	for _, attribute := range s.Attributes {
+		if attribute.Key == key {
+			for _, value := range attribute.Value {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+// collector stands in for an OpenTelemetry collector's OTLP/HTTP traces receiver.
+type collector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	resource map[string]any
+	spans    []collectedSpan
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+
+	c := &collector{resource: make(map[string]any)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s %s with Content-Type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string         `json:"key"`
+						Value map[string]any `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []collectedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, attribute := range rs.Resource.Attributes {
+				c.resource[attribute.Key] = attribute.Value["stringValue"]
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// tracedApplication returns a test application exporting every trace to a collector, whose
+// spans can be read once the returned function has flushed the tracer.
+func tracedApplication(t *testing.T, sampleRate float64) (*application, func() []collectedSpan) {
+	t.Helper()
+
+	c := newCollector(t)
+	app := newTestApplication(t)
+	app.tracer = trace.New(trace.NewOTLPExporter(c.URL+"/v1/traces", trace.String("service.name", "greenlight")), trace.Options{
+		SampleRate: sampleRate,
+		OnError:    func(err error) { t.Error(err) },
+	})
+	app.models = data.Traced(app.models)
+
+	return app, func() []collectedSpan {
+		if err := app.tracer.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if got := c.resource["service.name"]; got != "greenlight" {
+			t.Errorf("got service.name %v", got)
+		}
+		return c.spans
+	}
+}
+
+func TestTracing(t *testing.T) {
+	app, flush := tracedApplication(t, 1)
+
+	// Nothing listens on the SMTP port, so every delivery attempt fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	app.mailer = mailer.New("127.0.0.1", port, "", "", "Greenlight <no-reply@greenlight.danyel.dev>")
+
+	ts := newTestServer(t, app)
+	seedMovies(t, app)
+	insertUser(t, app, "Alice", "alice@example.com", true)
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", `{"email": "alice@example.com", "password": "pa55word"}`, map[string]string{"traceparent": traceparent})
+	assertStatus(t, res, http.StatusCreated)
+
+	var body struct {
+		AuthenticationToken struct {
+			Token string `json:"token"`
+		} `json:"authentication_token"`
+	}
+	if err := json.Unmarshal(res.body, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/1", body.AuthenticationToken.Token, "", nil)
+	assertStatus(t, res, http.StatusOK)
+	res = ts.do(t, http.MethodPost, "/v1/users", "", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word"}`, nil)
+	assertStatus(t, res, http.StatusCreated)
+
+	spans := flush()
+	byID := make(map[string]collectedSpan, len(spans))
+	for _, span := range spans {
+		byID[span.SpanID] = span
+	}
+	find := func(name string) collectedSpan {
+		t.Helper()
+		for _, span := range spans {
+			if span.Name == name {
+				return span
+			}
+		}
+		t.Fatalf("got no %s span in %+v", name, spans)
+		return collectedSpan{}
+	}
+	assertParent := func(child, parent collectedSpan) {
+		t.Helper()
+		if child.ParentSpanID != parent.SpanID || child.TraceID != parent.TraceID {
+			t.Errorf("got %s span with parent %q, want %s", child.Name, byID[child.ParentSpanID].Name, parent.Name)
+		}
+	}
+
+	// The first request continues the caller's trace.
+	login := find("POST /v1/tokens/authentication")
+	if login.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || login.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("got trace %s and parent %s", login.TraceID, login.ParentSpanID)
+	}
+	if login.Kind != int(trace.KindServer) || login.attribute("http.route") != "/v1/tokens/authentication" || login.attribute("http.response.status_code") != "201" {
+		t.Errorf("got server span %+v", login)
+	}
+	assertParent(find("UserModel.GetByEmail"), login)
+	assertParent(find("password.Matches"), login)
+	assertParent(find("TokenModel.New"), login)
+
+	show := find("GET /v1/movies/:id")
+	if show.TraceID == login.TraceID || show.ParentSpanID != "" {
+		t.Errorf("got request without traceparent in trace %s with parent %q", show.TraceID, show.ParentSpanID)
+	}
+	assertParent(find("UserModel.GetForToken"), show)
+	if get := find("MovieModel.Get"); get.Kind != int(trace.KindClient) || get.attribute("movie.id") != "1" {
+		t.Errorf("got query span %+v", get)
+	} else {
+		assertParent(get, show)
+	}
+
+	// Queries made inside a transaction are children of the request, next to the
+	// transaction's own span, and the email sent afterwards is part of the same trace.
+	register := find("POST /v1/users")
+	assertParent(find("password.Set"), register)
+	assertParent(find("Models.WithTx"), register)
+	assertParent(find("UserModel.Insert"), register)
+	send := find("Mailer.Send")
+	assertParent(send, register)
+	if send.Status.Code != 2 || send.attribute("mail.template") != "user_welcome.go.html" {
+		t.Errorf("got mail span %+v", send)
+	}
+
+	attempts := 0
+	for _, span := range spans {
+		if span.ParentSpanID == send.SpanID {
+			attempts++
+			if span.Kind != int(trace.KindClient) || span.Status.Code != 2 || span.Status.Message == "" {
+				t.Errorf("got delivery attempt span %+v", span)
+			}
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("got %d delivery attempt spans, want 3", attempts)
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	app, flush := tracedApplication(t, 0)
+	ts := newTestServer(t, app)
+
+	// New traces aren't sampled at a rate of 0, and neither are those the caller didn't
+	// sample, but traces the caller sampled are continued whatever the rate.
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", nil)
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"})
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"})
+	// A malformed header is ignored, as if it wasn't there.
+	ts.do(t, http.MethodGet, "/v1/healthcheck", "", "", map[string]string{"traceparent": "00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01"})
+
+	spans := flush()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1: %+v", len(spans), spans)
+	}
+	for _, span := range spans {
+		if span.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("got %s span in trace %s", span.Name, span.TraceID)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
 	"github.com/danyelkeddah/go-greenlight/internal/validator"
 	"net/http"
 	"time"
@@ -27,7 +28,7 @@ func (a *application) registerUserHandler(w http.ResponseWriter, r *http.Request
 		Activated: false,
 	}
 
-	err = user.Password.Set(input.Password)
+	err = user.Password.Set(r.Context(), input.Password)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -39,7 +40,18 @@ func (a *application) registerUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = a.models.Users.Insert(user)
+	// Insert the user and their activation token together, so we never end up with a
+	// user who can't be activated.
+	var token *data.Token
+	err = a.modelsFor(r).WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+		return err
+	})
 
 	if err != nil {
 		switch {
@@ -52,27 +64,28 @@ func (a *application) registerUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	token, err := a.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	a.sendWelcomeEmail(r, user, token)
+
+	err = a.writeJson(w, http.StatusCreated, envelop{"user": user}, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
+// sendWelcomeEmail sends a newly registered user their activation token in the background.
+func (a *application) sendWelcomeEmail(r *http.Request, user *data.User, token *data.Token) {
+	logger := a.loggerFor(r)
+	ctx := trace.Detach(r.Context())
 	a.background(func() {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
 			"userID":          user.ID,
 		}
-		err = a.mailer.Send(user.Email, "user_welcome.go.html", data)
+		err := a.sendMail(ctx, user.Email, "user_welcome.go.html", data)
 		if err != nil {
-			a.logger.PrintError(err, nil)
+			logger.PrintError(err, nil)
 		}
 	})
-
-	err = a.writeJson(w, http.StatusCreated, envelop{"user": user}, nil)
-	if err != nil {
-		a.serverErrorResponse(w, r, err)
-	}
 }
 
 func (a *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,13 +96,14 @@ func (a *application) activateUserHandler(w http.ResponseWriter, r *http.Request
 	err := a.readJSON(w, r, &input)
 	if err != nil {
 		a.badRequestResponse(w, r, err)
+		return
 	}
 	v := validator.New()
 	if data.ValidateTokenPlainText(v, input.TokenPlainText); !v.Valid() {
 		a.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	user, err := a.models.Users.GetForToken(data.ScopeActivation, input.TokenPlainText)
+	user, err := a.modelsFor(r).Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlainText)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -100,8 +114,21 @@ func (a *application) activateUserHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
-	user.Activated = true
-	err = a.models.Users.Update(user)
+
+	// Activate the user and remove their activation tokens atomically, so a token can't
+	// be left behind for an already activated account. The update is made on a copy, so
+	// user still matches the store if the transaction rolls back.
+	activated := *user
+	activated.Activated = true
+
+	err = a.modelsFor(r).WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), &activated)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, activated.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -111,12 +138,8 @@ func (a *application) activateUserHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
+	*user = activated
 
-	err = a.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
-	if err != nil {
-		a.serverErrorResponse(w, r, err)
-		return
-	}
 	// Send the updated user details to the client in a JSON response.
 	err = a.writeJson(w, http.StatusOK, envelop{"user": user}, nil)
 	if err != nil {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRegisterUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	insertUser(t, app, "Alice", "alice@example.com", true)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		mailed bool
+	}{
+		{"Valid", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word"}`, http.StatusCreated, true},
+		{"DuplicateEmail", `{"name": "Alice", "email": "alice@example.com", "password": "pa55word"}`, http.StatusUnprocessableEntity, false},
+		{"FailedValidation", `{"name": "", "email": "not-an-email", "password": "short"}`, http.StatusUnprocessableEntity, false},
+		{"EmptyBody", ``, http.StatusBadRequest, false},
+		{"MultipleValues", `{"name": "Bob"}{"name": "Carol"}`, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := &mockMailer{}
+			app.mailer = mailer
+
+			res := ts.do(t, http.MethodPost, "/v1/users", "", tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+
+			sent := mailer.messages()
+			if !tt.mailed {
+				if len(sent) != 0 {
+					t.Errorf("got %d emails sent; want none", len(sent))
+				}
+				return
+			}
+
+			if len(sent) != 1 {
+				t.Fatalf("got %d emails sent; want 1", len(sent))
+			}
+			if sent[0].recipient != "bob@example.com" || sent[0].templateFile != "user_welcome.go.html" {
+				t.Errorf("got email %q to %q; want user_welcome.go.html to bob@example.com", sent[0].templateFile, sent[0].recipient)
+			}
+			if token, _ := sent[0].data["activationToken"].(string); len(token) != 26 {
+				t.Errorf("got activation token %q; want a 26 character token", token)
+			}
+		})
+	}
+}
+
+func TestActivateUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	mailer := &mockMailer{}
+	app.mailer = mailer
+
+	res := ts.do(t, http.MethodPost, "/v1/users", "", `{"name": "Bob", "email": "bob@example.com", "password": "pa55word"}`, nil)
+	assertStatus(t, res, http.StatusCreated)
+	activationToken := mailer.messages()[0].data["activationToken"].(string)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"MissingToken", `{"token": ""}`, http.StatusUnprocessableEntity},
+		{"UnknownToken", `{"token": "AAAAAAAAAAAAAAAAAAAAAAAAAA"}`, http.StatusUnprocessableEntity},
+		{"BadlyFormedJSON", `{"token": `, http.StatusBadRequest},
+		{"Valid", `{"token": "` + activationToken + `"}`, http.StatusOK},
+		{"AlreadyUsed", `{"token": "` + activationToken + `"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPut, "/v1/users/activated", "", tt.body, nil)
+
+			assertStatus(t, res, tt.status)
+			assertGolden(t, res)
+		})
+	}
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Activated {
+		t.Error("user was not activated")
+	}
+}
@@ -0,0 +1,280 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MovieCache is an in-process LRU cache, with a TTL, of the results of MovieStore.Get and
+// MovieStore.GetAll. Every Insert, Update and Delete made through the wrapped models drops
+// the cached movie and all cached lists, since any list could include the changed movie.
+//
+// The cache is local to one process, so with several API instances a change made through
+// one of them is only seen by the others once their entries expire. Keep the TTL short.
+type MovieCache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation is bumped by every write. A read which missed the cache only stores its
+	// result if no write happened while it was querying the database, so it can't put back
+	// a value which was invalidated in the meantime.
+	generation uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheEntry struct {
+	key      string
+	expires  time.Time
+	movie    *Movie
+	movies   []*Movie
+	metadata Metadata
+}
+
+// NewMovieCache returns a MovieCache holding at most capacity entries, each for at most ttl.
+func NewMovieCache(capacity int, ttl time.Duration) *MovieCache {
+	return &MovieCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Wrap returns a copy of models whose Movies are served through the cache. Transactions
+// started with the returned models are wrapped as well: reads inside them bypass the cache,
+// and their writes invalidate it both immediately and once the transaction has finished.
+func (c *MovieCache) Wrap(models Models) Models {
+	models.Movies = &cachedMovies{store: models.Movies, cache: c}
+	if models.Transactor != nil {
+		models.Transactor = &cachedTransactor{transactor: models.Transactor, cache: c}
+	}
+	return models
+}
+
+// Stats returns the hit and miss counters and the current number of entries.
+func (c *MovieCache) Stats() map[string]any {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return map[string]any{
+		"hits":     c.hits.Load(),
+		"misses":   c.misses.Load(),
+		"entries":  entries,
+		"capacity": c.capacity,
+	}
+}
+
+// get returns the live entry for key, if any, along with the current generation.
+func (c *MovieCache) get(key string) (*cacheEntry, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, c.generation
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, c.generation
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
+	return entry, c.generation
+}
+
+// set stores entry, unless the cache was invalidated since generation was read.
+func (c *MovieCache) set(entry *cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	entry.expires = time.Now().Add(c.ttl)
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the cached movie with the given id, if id is not zero, and every
+// cached list.
+func (c *MovieCache) invalidate(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if elem, ok := c.entries[movieCacheKey(id)]; ok {
+		c.remove(elem)
+	}
+
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, "list:") {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *MovieCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func movieCacheKey(id int64) string {
+	return fmt.Sprintf("movie:%d", id)
+}
+
+func listCacheKey(title string, genres []string, rating string, releasedAfter, releasedBefore Date, filters Filters) string {
+	return fmt.Sprintf("list:%q:%q:%q:%s:%s:%q:%d:%d", title, genres, rating, releasedAfter, releasedBefore, filters.Sort, filters.Page, filters.PageSize)
+}
+
+// copyMovie returns a deep copy of movie. Callers are free to modify the movies they get
+// back, as updateMovieHandler does, so the cache never hands out the values it holds.
+func copyMovie(movie *Movie) *Movie {
+	cp := *movie
+	if movie.Genres != nil {
+		cp.Genres = append([]string{}, movie.Genres...)
+	}
+	return &cp
+}
+
+func copyMovies(movies []*Movie) []*Movie {
+	cp := make([]*Movie, len(movies))
+	for i, movie := range movies {
+		cp[i] = copyMovie(movie)
+	}
+	return cp
+}
+
+type cachedMovies struct {
+	store MovieStore
+	cache *MovieCache
+
+	// inTx is set for the movies of a transaction, which must read their own uncommitted
+	// writes from the database. written records the IDs of the movies it changed.
+	inTx    bool
+	written []int64
+}
+
+func (m *cachedMovies) Insert(ctx context.Context, movie *Movie) error {
+	err := m.store.Insert(ctx, movie)
+	m.invalidate(0)
+	return err
+}
+
+// Get reads through the cache, except for reads which asked for the primary with
+// WithPrimary, since those need the latest version of the movie.
+func (m *cachedMovies) Get(ctx context.Context, id int64) (*Movie, error) {
+	if m.inTx || usePrimary(ctx) {
+		return m.store.Get(ctx, id)
+	}
+
+	key := movieCacheKey(id)
+
+	entry, generation := m.cache.get(key)
+	if entry != nil {
+		return copyMovie(entry.movie), nil
+	}
+
+	movie, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.set(&cacheEntry{key: key, movie: copyMovie(movie)}, generation)
+
+	return movie, nil
+}
+
+func (m *cachedMovies) GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore Date, filters Filters) ([]*Movie, Metadata, error) {
+	if m.inTx || usePrimary(ctx) {
+		return m.store.GetAll(ctx, title, genres, rating, releasedAfter, releasedBefore, filters)
+	}
+
+	key := listCacheKey(title, genres, rating, releasedAfter, releasedBefore, filters)
+
+	entry, generation := m.cache.get(key)
+	if entry != nil {
+		return copyMovies(entry.movies), entry.metadata, nil
+	}
+
+	movies, metadata, err := m.store.GetAll(ctx, title, genres, rating, releasedAfter, releasedBefore, filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	m.cache.set(&cacheEntry{key: key, movies: copyMovies(movies), metadata: metadata}, generation)
+
+	return movies, metadata, nil
+}
+
+func (m *cachedMovies) Update(ctx context.Context, movie *Movie) error {
+	err := m.store.Update(ctx, movie)
+	m.invalidate(movie.ID)
+	return err
+}
+
+func (m *cachedMovies) Delete(ctx context.Context, id int64, version int32) error {
+	err := m.store.Delete(ctx, id, version)
+	m.invalidate(id)
+	return err
+}
+
+// invalidate is called even when a write fails, as the failure may have come after the
+// change was made, for example when the query timed out waiting for its result.
+func (m *cachedMovies) invalidate(id int64) {
+	m.cache.invalidate(id)
+	if m.inTx {
+		m.written = append(m.written, id)
+	}
+}
+
+type cachedTransactor struct {
+	transactor Transactor
+	cache      *MovieCache
+}
+
+func (t *cachedTransactor) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	var movies *cachedMovies
+
+	err := t.transactor.WithTx(ctx, func(tx Models) error {
+		movies = &cachedMovies{store: tx.Movies, cache: t.cache, inTx: true}
+		tx.Movies = movies
+		return fn(tx)
+	})
+
+	// A read made between a write and the commit may have cached the old value again.
+	if movies != nil {
+		for _, id := range movies.written {
+			t.cache.invalidate(id)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyKey records a request made with an Idempotency-Key header, so that a retry of
+// the same request gets the original response back instead of repeating its side effects.
+// Keys are scoped to the user who sent them.
+//
+// A key whose Status is 0 belongs to a request which is still in progress. Its Expiry is then
+// a short lease, so a key left behind by a request which never finished can be reused.
+type IdempotencyKey struct {
+	Key         string
+	UserID      int64
+	RequestHash []byte
+	Status      int
+	Header      map[string]string
+	Body        []byte
+	Expiry      time.Time
+}
+
+type IdempotencyKeyModel struct {
+	DB           DBTX
+	QueryTimeout time.Duration
+}
+
+// Reserve claims key for a new request. If the user already has a live record for the key,
+// nothing is stored and that record is returned instead; otherwise Reserve returns nil. An
+// expired record is replaced.
+func (m IdempotencyKeyModel) Reserve(ctx context.Context, key *IdempotencyKey) (*IdempotencyKey, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, user_id, request_hash, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, header = NULL, body = NULL, expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry <= NOW()
+		RETURNING key`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var claimed string
+	err := m.DB.QueryRowContext(ctx, query, key.Key, key.UserID, key.RequestHash, key.Expiry).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, queryError(ctx, err)
+	}
+
+	query = `
+		SELECT request_hash, COALESCE(status, 0), header, body, expiry
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	existing := IdempotencyKey{Key: key.Key, UserID: key.UserID}
+	var header []byte
+
+	err = m.DB.QueryRowContext(ctx, query, key.UserID, key.Key).Scan(
+		&existing.RequestHash,
+		&existing.Status,
+		&header,
+		&existing.Body,
+		&existing.Expiry,
+	)
+	if err != nil {
+		// The record expired and was deleted in between; the client can simply retry.
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrEditConflict
+		}
+		return nil, queryError(ctx, err)
+	}
+
+	if header != nil {
+		err = json.Unmarshal(header, &existing.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &existing, nil
+}
+
+// Complete records the response to the request which reserved key, keeping it until
+// key.Expiry.
+func (m IdempotencyKeyModel) Complete(ctx context.Context, key *IdempotencyKey) error {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $1, header = $2, body = $3, expiry = $4
+		WHERE user_id = $5 AND key = $6`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, key.Status, header, key.Body, key.Expiry, key.UserID, key.Key)
+	return queryError(ctx, err)
+}
+
+// Release deletes the reservation of a request which didn't complete, so it can be retried
+// with the same key.
+func (m IdempotencyKeyModel) Release(ctx context.Context, userID int64, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return queryError(ctx, err)
+}
+
+// DeleteExpired removes every expired record.
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context) error {
+	query := `DELETE FROM idempotency_keys WHERE expiry <= NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return queryError(ctx, err)
+}
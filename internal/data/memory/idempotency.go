@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"time"
+)
+
+type idempotencyID struct {
+	userID int64
+	key    string
+}
+
+type IdempotencyKeyModel struct {
+	store *Store
+	inTx  bool
+}
+
+func (m *IdempotencyKeyModel) Reserve(ctx context.Context, key *data.IdempotencyKey) (*data.IdempotencyKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	id := idempotencyID{userID: key.UserID, key: key.Key}
+	if existing, ok := m.store.idempotencyKeys[id]; ok && existing.Expiry.After(time.Now()) {
+		c := *existing
+		return &c, nil
+	}
+
+	c := *key
+	c.Status, c.Header, c.Body = 0, nil, nil
+	m.store.idempotencyKeys[id] = &c
+	return nil, nil
+}
+
+func (m *IdempotencyKeyModel) Complete(ctx context.Context, key *data.IdempotencyKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	id := idempotencyID{userID: key.UserID, key: key.Key}
+	existing, ok := m.store.idempotencyKeys[id]
+	if !ok {
+		return nil
+	}
+
+	c := *existing
+	c.Status, c.Header, c.Body, c.Expiry = key.Status, key.Header, key.Body, key.Expiry
+	m.store.idempotencyKeys[id] = &c
+	return nil
+}
+
+func (m *IdempotencyKeyModel) Release(ctx context.Context, userID int64, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	id := idempotencyID{userID: userID, key: key}
+	if existing, ok := m.store.idempotencyKeys[id]; ok && existing.Status == 0 {
+		delete(m.store.idempotencyKeys, id)
+	}
+	return nil
+}
+
+func (m *IdempotencyKeyModel) DeleteExpired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	now := time.Now()
+	for id, key := range m.store.idempotencyKeys {
+		if !key.Expiry.After(now) {
+			delete(m.store.idempotencyKeys, id)
+		}
+	}
+	return nil
+}
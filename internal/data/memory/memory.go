@@ -0,0 +1,143 @@
+// Package memory provides a thread-safe, in-memory implementation of data.Models. It is
+// meant for tests and local demos: everything is lost when the process exits.
+package memory
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"sync"
+)
+
+// Store holds every record kept by the in-memory models.
+type Store struct {
+	// gate is held for writing by a running transaction, so that no other operation can
+	// observe or modify the store until it commits or rolls back.
+	gate sync.RWMutex
+	mu   sync.Mutex
+
+	movies      map[int64]*data.Movie
+	nextMovieID int64
+	users       map[int64]*data.User
+	nextUserID  int64
+	tokens      []*data.Token
+
+	idempotencyKeys map[idempotencyID]*data.IdempotencyKey
+}
+
+// New returns a set of models backed by a new, empty in-memory store.
+func New() data.Models {
+	s := &Store{
+		movies: make(map[int64]*data.Movie),
+		users:  make(map[int64]*data.User),
+
+		idempotencyKeys: make(map[idempotencyID]*data.IdempotencyKey),
+	}
+
+	m := s.models(false)
+	m.Transactor = s
+	return m
+}
+
+func (s *Store) models(inTx bool) data.Models {
+	return data.Models{
+		Movies: &MovieModel{store: s, inTx: inTx},
+		Users:  &UserModel{store: s, inTx: inTx},
+		Tokens: &TokenModel{store: s, inTx: inTx},
+
+		IdempotencyKeys: &IdempotencyKeyModel{store: s, inTx: inTx},
+	}
+}
+
+// lock acquires the store for a single operation. Operations run inside a transaction
+// already hold the gate exclusively, so only the data mutex is taken for them.
+func (s *Store) lock(inTx bool) func() {
+	if !inTx {
+		s.gate.RLock()
+	}
+	s.mu.Lock()
+
+	return func() {
+		s.mu.Unlock()
+		if !inTx {
+			s.gate.RUnlock()
+		}
+	}
+}
+
+// WithTx runs fn with exclusive access to the store, restoring the previous state if fn
+// returns an error or panics.
+func (s *Store) WithTx(ctx context.Context, fn func(tx data.Models) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.gate.Lock()
+	defer s.gate.Unlock()
+
+	snapshot := s.snapshot()
+
+	defer func() {
+		if p := recover(); p != nil {
+			s.restore(snapshot)
+			panic(p)
+		}
+	}()
+
+	err = fn(s.models(true))
+	if err != nil {
+		s.restore(snapshot)
+		return err
+	}
+
+	return nil
+}
+
+type snapshot struct {
+	movies      map[int64]*data.Movie
+	nextMovieID int64
+	users       map[int64]*data.User
+	nextUserID  int64
+	tokens      []*data.Token
+
+	idempotencyKeys map[idempotencyID]*data.IdempotencyKey
+}
+
+// snapshot copies the store's state. Records are never mutated in place once stored, so
+// copying the containers is enough.
+func (s *Store) snapshot() snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := snapshot{
+		movies:      make(map[int64]*data.Movie, len(s.movies)),
+		nextMovieID: s.nextMovieID,
+		users:       make(map[int64]*data.User, len(s.users)),
+		nextUserID:  s.nextUserID,
+		tokens:      append([]*data.Token(nil), s.tokens...),
+
+		idempotencyKeys: make(map[idempotencyID]*data.IdempotencyKey, len(s.idempotencyKeys)),
+	}
+	for id, movie := range s.movies {
+		snap.movies[id] = movie
+	}
+	for id, user := range s.users {
+		snap.users[id] = user
+	}
+	for id, key := range s.idempotencyKeys {
+		snap.idempotencyKeys[id] = key
+	}
+
+	return snap
+}
+
+func (s *Store) restore(snap snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.movies = snap.movies
+	s.nextMovieID = snap.nextMovieID
+	s.users = snap.users
+	s.nextUserID = snap.nextUserID
+	s.tokens = snap.tokens
+	s.idempotencyKeys = snap.idempotencyKeys
+}
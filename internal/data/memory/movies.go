@@ -0,0 +1,227 @@
+package memory
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type MovieModel struct {
+	store *Store
+	inTx  bool
+}
+
+func copyMovie(movie *data.Movie) *data.Movie {
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+	return &c
+}
+
+func (m *MovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	m.store.nextMovieID++
+	movie.ID = m.store.nextMovieID
+	movie.CreatedAt = time.Now()
+	movie.Version = 1
+
+	m.store.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (m *MovieModel) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if id < 1 {
+		return nil, data.ErrRecordNotFound
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	movie, ok := m.store.movies[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m *MovieModel) Update(ctx context.Context, movie *data.Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	// Mimic the "WHERE id = $1 AND version = $2" optimistic locking of the SQL models.
+	current, ok := m.store.movies[movie.ID]
+	if !ok || current.Version != movie.Version {
+		return data.ErrEditConflict
+	}
+
+	movie.Version++
+	m.store.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (m *MovieModel) Delete(ctx context.Context, id int64, version int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id < 1 {
+		return data.ErrRecordNotFound
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	movie, ok := m.store.movies[id]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+	if version != 0 && movie.Version != version {
+		return data.ErrEditConflict
+	}
+
+	delete(m.store.movies, id)
+	return nil
+}
+
+func (m *MovieModel) GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore data.Date, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, data.Metadata{}, err
+	}
+
+	column, direction := filters.SortColumn(), filters.SortDirection()
+
+	unlock := m.store.lock(m.inTx)
+	matched := []*data.Movie{}
+	for _, movie := range m.store.movies {
+		if !matchesTitle(movie.Title, title) || !containsAll(movie.Genres, genres) {
+			continue
+		}
+		if rating != "" && movie.Rating != rating {
+			continue
+		}
+		if !releasedAfter.IsZero() && (movie.ReleaseDate.IsZero() || movie.ReleaseDate.Before(releasedAfter.Time)) {
+			continue
+		}
+		if !releasedBefore.IsZero() && (movie.ReleaseDate.IsZero() || movie.ReleaseDate.After(releasedBefore.Time)) {
+			continue
+		}
+		matched = append(matched, copyMovie(movie))
+	}
+	unlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		c := compareMovies(matched[i], matched[j], column)
+		if c == 0 {
+			return matched[i].ID < matched[j].ID
+		}
+		if direction == "DESC" {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	totalRecords := len(matched)
+	start := filters.Offset()
+	if start > totalRecords {
+		start = totalRecords
+	}
+	end := start + filters.Limit()
+	if end > totalRecords {
+		end = totalRecords
+	}
+
+	metadata := data.CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return matched[start:end], metadata, nil
+}
+
+// matchesTitle approximates PostgreSQL's simple full-text search: every word of the query
+// must appear as a whole word in the title, ignoring case.
+func matchesTitle(title, query string) bool {
+	if query == "" {
+		return true
+	}
+
+	words := make(map[string]bool)
+	for _, word := range splitWords(title) {
+		words[word] = true
+	}
+	for _, word := range splitWords(query) {
+		if !words[word] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsAll mimics the "genres @> $2" array containment check.
+func containsAll(values, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, v := range values {
+			if v == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func compareMovies(a, b *data.Movie, column string) int {
+	switch column {
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "year":
+		return compareInts(int64(a.Year), int64(b.Year))
+	case "runtime":
+		return compareInts(int64(a.RunTime), int64(b.RunTime))
+	case "release_date":
+		// PostgreSQL sorts NULLs last in ascending order.
+		switch {
+		case a.ReleaseDate.IsZero() && b.ReleaseDate.IsZero():
+			return 0
+		case a.ReleaseDate.IsZero():
+			return 1
+		case b.ReleaseDate.IsZero():
+			return -1
+		}
+		return compareInts(a.ReleaseDate.Unix(), b.ReleaseDate.Unix())
+	default:
+		return compareInts(a.ID, b.ID)
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
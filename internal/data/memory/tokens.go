@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"time"
+)
+
+type TokenModel struct {
+	store *Store
+	inTx  bool
+}
+
+func (m *TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	token, err := data.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m *TokenModel) Insert(ctx context.Context, token *data.Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	c := *token
+	c.Plaintext = ""
+	m.store.tokens = append(m.store.tokens, &c)
+	return nil
+}
+
+func (m *TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	// Build a new slice rather than filtering in place, so snapshots taken by a running
+	// transaction keep their own view of the tokens.
+	kept := make([]*data.Token, 0, len(m.store.tokens))
+	for _, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			continue
+		}
+		kept = append(kept, token)
+	}
+	m.store.tokens = kept
+	return nil
+}
@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"context"
+	"crypto/sha256"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"strings"
+	"time"
+)
+
+type UserModel struct {
+	store *Store
+	inTx  bool
+}
+
+func copyUser(user *data.User) *data.User {
+	c := *user
+	return &c
+}
+
+// emailTaken reports whether another user already has the email address. Like the citext
+// column in PostgreSQL, the comparison ignores case.
+func (m *UserModel) emailTaken(email string, exceptID int64) bool {
+	for id, user := range m.store.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *UserModel) Insert(ctx context.Context, user *data.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return data.ErrDuplicateEmail
+	}
+
+	m.store.nextUserID++
+	user.ID = m.store.nextUserID
+	user.CreatedAt = time.Now()
+	user.Version = 1
+
+	m.store.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	for _, user := range m.store.users {
+		if strings.EqualFold(user.Email, email) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (m *UserModel) Update(ctx context.Context, user *data.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	if m.emailTaken(user.Email, user.ID) {
+		return data.ErrDuplicateEmail
+	}
+
+	current, ok := m.store.users[user.ID]
+	if !ok || current.Version != user.Version {
+		return data.ErrEditConflict
+	}
+
+	user.Version++
+	m.store.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (m *UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	unlock := m.store.lock(m.inTx)
+	defer unlock()
+
+	now := time.Now()
+	for _, token := range m.store.tokens {
+		if string(token.Hash) != string(tokenHash[:]) || token.Scope != tokenScope || !token.Expiry.After(now) {
+			continue
+		}
+
+		user, ok := m.store.users[token.UserID]
+		if !ok {
+			break
+		}
+		return copyUser(user), nil
+	}
+
+	return nil, data.ErrRecordNotFound
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -10,22 +13,135 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+type MovieStore interface {
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore Date, filters Filters) ([]*Movie, Metadata, error)
+	Update(ctx context.Context, movie *Movie) error
+	// Delete removes the movie, failing with ErrEditConflict if version is not zero and the
+	// movie is no longer at that version.
+	Delete(ctx context.Context, id int64, version int32) error
+}
+
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+}
+
+// IdempotencyKeyStore keeps the responses to requests sent with an Idempotency-Key header.
+type IdempotencyKeyStore interface {
+	Reserve(ctx context.Context, key *IdempotencyKey) (*IdempotencyKey, error)
+	Complete(ctx context.Context, key *IdempotencyKey) error
+	Release(ctx context.Context, userID int64, key string) error
+	DeleteExpired(ctx context.Context) error
+}
+
+// Transactor runs fn with a copy of the models bound to a single transaction, committing
+// when fn returns nil and rolling back when it returns an error or panics.
+type Transactor interface {
+	WithTx(ctx context.Context, fn func(tx Models) error) error
+}
+
 type Models struct {
-	Movies interface {
-		Insert(movie *Movie) error
-		Get(id int64) (*Movie, error)
-		GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
-		Update(movie *Movie) error
-		Delete(id int64) error
+	Movies MovieStore
+	Users  UserStore
+	Tokens TokenStore
+
+	IdempotencyKeys IdempotencyKeyStore
+
+	// Transactor is nil for models which are already bound to a transaction.
+	Transactor Transactor
+}
+
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so a model can run its queries either
+// directly against the connection pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// NewModels returns the PostgreSQL backed models. Every query is bounded by queryTimeout
+// on top of whatever deadline or cancellation the caller's context already carries. When
+// replicas is not nil, read-only lookups are routed to its read replicas.
+func NewModels(db *sql.DB, queryTimeout time.Duration, replicas *ReplicaSet) Models {
+	return Models{
+		Movies:     &MovieModel{DB: db, QueryTimeout: queryTimeout, Replicas: replicas},
+		Users:      UserModel{DB: db, QueryTimeout: queryTimeout, Replicas: replicas},
+		Tokens:     TokenModel{DB: db, QueryTimeout: queryTimeout},
+		Transactor: &pgTransactor{db: db, queryTimeout: queryTimeout},
+
+		IdempotencyKeys: IdempotencyKeyModel{DB: db, QueryTimeout: queryTimeout},
 	}
-	Users  UserModel
-	Tokens TokenModel
 }
 
-func NewModels(db *sql.DB) Models {
+func newModels(db DBTX, queryTimeout time.Duration) Models {
 	return Models{
-		Movies: &MovieModel{DB: db},
-		Users:  UserModel{DB: db},
-		Tokens: TokenModel{DB: db},
+		Movies: &MovieModel{DB: db, QueryTimeout: queryTimeout},
+		Users:  UserModel{DB: db, QueryTimeout: queryTimeout},
+		Tokens: TokenModel{DB: db, QueryTimeout: queryTimeout},
+
+		IdempotencyKeys: IdempotencyKeyModel{DB: db, QueryTimeout: queryTimeout},
+	}
+}
+
+// WithTx runs fn inside a single transaction. The Models passed to fn are bound to that
+// transaction, so every call made through them is committed together when fn returns nil,
+// and rolled back if fn returns an error or panics. Calling WithTx on models which are
+// already bound to a transaction simply joins the outer transaction.
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.Transactor == nil {
+		return fn(m)
+	}
+	return m.Transactor.WithTx(ctx, fn)
+}
+
+type pgTransactor struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+func (t *pgTransactor) WithTx(ctx context.Context, fn func(tx Models) error) (err error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(newModels(tx, t.queryTimeout))
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %s)", err, rollbackErr)
+		}
+		return err
+	}
+
+	return queryError(ctx, tx.Commit())
+}
+
+// queryError makes sure a query which failed because its context was cancelled or timed out
+// can be detected with errors.Is(err, context.DeadlineExceeded) or context.Canceled. The
+// PostgreSQL driver reports these as a "canceling statement" server error instead.
+func queryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %s", ctxErr, err)
 	}
+	return err
 }
@@ -0,0 +1,28 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestQueryError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A query which succeeded stays a success, even if its context ended right after.
+	if err := queryError(ctx, nil); err != nil {
+		t.Errorf("got %v for a successful query; want nil", err)
+	}
+
+	// The driver's error for a cancelled query can be matched against the context's.
+	err := queryError(ctx, errors.New("pq: canceling statement due to user request"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v; want an error wrapping context.Canceled", err)
+	}
+
+	other := errors.New("pq: relation does not exist")
+	if err := queryError(context.Background(), other); err != other {
+		t.Errorf("got %v; want the query's error", err)
+	}
+}
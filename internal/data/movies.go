@@ -7,29 +7,50 @@ import (
 	"fmt"
 	"github.com/danyelkeddah/go-greenlight/internal/validator"
 	"github.com/lib/pq"
+	"regexp"
 	"time"
 )
 
 type MovieModel struct {
-	DB *sql.DB
+	DB           DBTX
+	QueryTimeout time.Duration
+	// Replicas, when set, serves Get and GetAll. Models bound to a transaction leave it nil.
+	Replicas *ReplicaSet
+}
+
+func (m *MovieModel) reader(ctx context.Context) DBTX {
+	if m.Replicas == nil {
+		return m.DB
+	}
+	return m.Replicas.reader(ctx)
 }
 
 type Movie struct {
-	ID        int64     `json:"id,omitempty"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title,omitempty"`
-	Year      int32     `json:"year,omitempty"`
-	RunTime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version,omitempty"`
+	ID               int64     `json:"id,omitempty"`
+	CreatedAt        time.Time `json:"-"`
+	Title            string    `json:"title,omitempty"`
+	Year             int32     `json:"year,omitempty"`
+	RunTime          Runtime   `json:"runtime,omitempty"`
+	Genres           []string  `json:"genres,omitempty"`
+	Synopsis         string    `json:"synopsis,omitempty"`
+	Rating           string    `json:"rating,omitempty"`
+	ReleaseDate      Date      `json:"release_date"`
+	OriginalLanguage string    `json:"original_language,omitempty"`
+	Version          int32     `json:"version,omitempty"`
 }
 
+// Ratings holds the MPAA certifications a movie may be given.
+var Ratings = []string{"G", "PG", "PG-13", "R", "NC-17"}
+
+// LanguageRX matches a lowercase ISO 639-1 language code such as "en" or "fr".
+var LanguageRX = regexp.MustCompile("^[a-z]{2}$")
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
 
 	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
+	v.Check(movie.Year >= 1888, "year", "must be 1888 or later")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
 
 	v.Check(movie.RunTime != 0, "runtime", "must be provided")
@@ -40,41 +61,74 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	v.Check(len(movie.Synopsis) <= 5000, "synopsis", "must not be more than 5000 bytes long")
+
+	if movie.Rating != "" {
+		v.Check(validator.PermittedValue(movie.Rating, Ratings...), "rating", "must be one of G, PG, PG-13, R or NC-17")
+	}
+
+	if !movie.ReleaseDate.IsZero() {
+		v.Check(movie.ReleaseDate.Year() >= 1888, "release_date", "must be 1888 or later")
+	}
+
+	if movie.OriginalLanguage != "" {
+		v.Check(validator.Matches(movie.OriginalLanguage, LanguageRX), "original_language", "must be a two-letter ISO 639-1 code")
+	}
 }
 
-func (m *MovieModel) Insert(movie *Movie) error {
+func (m *MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
-			INSERT INTO movies (title, year, runtime, genres)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO movies (title, year, runtime, genres, synopsis, rating, release_date, original_language)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 			RETURNING id, created_at, version
 			`
 
-	args := []any{movie.Title, movie.Year, movie.RunTime, pq.Array(movie.Genres)}
+	args := []any{
+		movie.Title,
+		movie.Year,
+		movie.RunTime,
+		pq.Array(movie.Genres),
+		movie.Synopsis,
+		movie.Rating,
+		movie.ReleaseDate,
+		movie.OriginalLanguage,
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	return nil
 }
 
-func (m *MovieModel) Get(id int64) (*Movie, error) {
+func (m *MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-				SELECT  id, created_at, title, year, runtime, genres, version FROM movies where id = $1
+				SELECT  id, created_at, title, year, runtime, genres, synopsis, rating, release_date, original_language, version
+				FROM movies where id = $1
 			`
 
 	var movie Movie
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.reader(ctx).QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.RunTime,
 		pq.Array(&movie.Genres),
+		&movie.Synopsis,
+		&movie.Rating,
+		&movie.ReleaseDate,
+		&movie.OriginalLanguage,
 		&movie.Version,
 	)
 
@@ -83,17 +137,18 @@ func (m *MovieModel) Get(id int64) (*Movie, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
 	}
 
 	return &movie, nil
 }
 
-func (m *MovieModel) Update(movie *Movie) error {
+func (m *MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
-			UPDATE movies set title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-			WHERE id = $5 AND VERSION = $6 RETURNING version
+			UPDATE movies set title = $1, year = $2, runtime = $3, genres = $4, synopsis = $5, rating = $6,
+			release_date = $7, original_language = $8, version = version + 1
+			WHERE id = $9 AND VERSION = $10 RETURNING version
 			`
 
 	args := []any{
@@ -101,10 +156,14 @@ func (m *MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.RunTime,
 		pq.Array(movie.Genres),
+		movie.Synopsis,
+		movie.Rating,
+		movie.ReleaseDate,
+		movie.OriginalLanguage,
 		movie.ID,
 		movie.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 
@@ -113,23 +172,23 @@ func (m *MovieModel) Update(movie *Movie) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return queryError(ctx, err)
 		}
 	}
 	return nil
 }
 
-func (m *MovieModel) Delete(id int64) error {
+func (m *MovieModel) Delete(ctx context.Context, id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `DELETE FROM movies where id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	query := `DELETE FROM movies where id = $1 AND ($2 = 0 OR version = $2)`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, version)
 	if err != nil {
-		return err
+		return queryError(ctx, err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -138,30 +197,53 @@ func (m *MovieModel) Delete(id int64) error {
 	}
 
 	if rowsAffected == 0 {
-		return ErrRecordNotFound
+		if version == 0 {
+			return ErrRecordNotFound
+		}
+		return m.missingOrConflict(ctx, id)
 	}
 
 	return nil
 }
 
-func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// missingOrConflict tells apart the two reasons a versioned write can match no rows: the
+// movie is gone, or another client changed it first.
+func (m *MovieModel) missingOrConflict(ctx context.Context, id int64) error {
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	if !exists {
+		return ErrRecordNotFound
+	}
+	return ErrEditConflict
+}
+
+func (m *MovieModel) GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore Date, filters Filters) ([]*Movie, Metadata, error) {
 	query := fmt.Sprintf(
 		`
-				SELECT Count(*) OVER(), id, created_at, title, year, runtime, genres, version
+				SELECT Count(*) OVER(), id, created_at, title, year, runtime, genres, synopsis, rating, release_date,
+				original_language, version
 				FROM movies
 				where (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 				AND (genres @> $2 OR $2 = '{}')
+				AND (rating = $3 OR $3 = '')
+				AND (release_date >= $4::date OR $4::date IS NULL)
+				AND (release_date <= $5::date OR $5::date IS NULL)
 				ORDER BY  %s %s, id ASC
-				LIMIT $3 OFFSET $4
-			`, filters.sortColumn(), filters.sortDirection(),
+				LIMIT $6 OFFSET $7
+			`, filters.SortColumn(), filters.SortDirection(),
 	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{title, pq.Array(genres), rating, releasedAfter, releasedBefore, filters.Limit(), filters.Offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres), filters.limit(), filters.offset())
+	rows, err := m.reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, queryError(ctx, err)
 	}
 
 	defer rows.Close()
@@ -177,6 +259,10 @@ func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*
 			&movie.Year,
 			&movie.RunTime,
 			pq.Array(&movie.Genres),
+			&movie.Synopsis,
+			&movie.Rating,
+			&movie.ReleaseDate,
+			&movie.OriginalLanguage,
 			&movie.Version,
 		)
 		if err != nil {
@@ -185,9 +271,9 @@ func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*
 		movies = append(movies, &movie)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, queryError(ctx, err)
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	return movies, metadata, nil
 }
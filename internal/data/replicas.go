@@ -0,0 +1,180 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type primaryContextKey struct{}
+
+// WithPrimary returns a context whose reads are always sent to the primary database. Use it
+// on read-your-writes paths, such as loading a record which is about to be updated, where
+// replication lag on a replica could return stale data.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// ReplicaSet routes read-only queries across a set of read replicas in round-robin order,
+// skipping replicas which failed their last health check. Writes, and reads made with a
+// WithPrimary context, always go to the primary.
+type ReplicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     uint64
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+
+	mu        sync.Mutex
+	lastError string
+	latency   time.Duration
+}
+
+// NewReplicaSet returns a ReplicaSet for the primary and the given replica pools, keyed by a
+// name safe to publish in stats (such as the DSN with its password redacted). All replicas
+// start out healthy.
+func NewReplicaSet(primary *sql.DB, replicas map[string]*sql.DB) *ReplicaSet {
+	rs := &ReplicaSet{
+		primary: primary,
+		stop:    make(chan struct{}),
+	}
+
+	names := make([]string, 0, len(replicas))
+	for name := range replicas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r := &replica{name: name, db: replicas[name]}
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+
+	return rs
+}
+
+// reader returns the pool a read-only query should run against.
+func (rs *ReplicaSet) reader(ctx context.Context) DBTX {
+	if usePrimary(ctx) || len(rs.replicas) == 0 {
+		return rs.primary
+	}
+
+	start := atomic.AddUint64(&rs.next, 1)
+	for i := 0; i < len(rs.replicas); i++ {
+		r := rs.replicas[(start+uint64(i))%uint64(len(rs.replicas))]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+
+	// Every replica is down, so fall back to the primary rather than failing the read.
+	return rs.primary
+}
+
+// MonitorHealth pings every replica each interval, taking failing replicas out of rotation
+// until they respond again. It returns when Close is called.
+func (rs *ReplicaSet) MonitorHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		rs.checkHealth(interval)
+
+		select {
+		case <-ticker.C:
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+func (rs *ReplicaSet) checkHealth(timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, r := range rs.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := r.db.PingContext(ctx)
+
+			r.mu.Lock()
+			r.latency = time.Since(start)
+			r.lastError = ""
+			if err != nil {
+				r.lastError = err.Error()
+			}
+			r.mu.Unlock()
+
+			r.healthy.Store(err == nil)
+		}(r)
+	}
+
+	wg.Wait()
+}
+
+// Stats returns the connection pool statistics of the primary and of every replica, along
+// with the result of each replica's last health check.
+func (rs *ReplicaSet) Stats() map[string]any {
+	replicas := make([]map[string]any, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		stats := map[string]any{
+			"name":       r.name,
+			"healthy":    r.healthy.Load(),
+			"latency_ms": r.latency.Milliseconds(),
+			"last_error": r.lastError,
+			"pool":       r.db.Stats(),
+		}
+		r.mu.Unlock()
+		replicas = append(replicas, stats)
+	}
+
+	return map[string]any{
+		"primary":  rs.primary.Stats(),
+		"replicas": replicas,
+	}
+}
+
+// PoolStats returns the statistics of the primary's connection pool and of each replica's,
+// keyed by "primary" and the name of the replica.
+func (rs *ReplicaSet) PoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"primary": rs.primary.Stats()}
+	for _, r := range rs.replicas {
+		stats[r.name] = r.db.Stats()
+	}
+	return stats
+}
+
+// Close stops the health checks and closes the replica pools. The primary is left open.
+func (rs *ReplicaSet) Close() error {
+	rs.once.Do(func() { close(rs.stop) })
+
+	var firstErr error
+	for _, r := range rs.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
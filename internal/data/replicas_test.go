@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openPools returns n SQLite pools, which stand in for PostgreSQL servers as the replica set
+// only pings them and hands them out.
+func openPools(t *testing.T, n int) []*sql.DB {
+	t.Helper()
+
+	pools := make([]*sql.DB, n)
+	for i := range pools {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), fmt.Sprintf("db-%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		pools[i] = db
+	}
+	return pools
+}
+
+func TestReplicaSetReader(t *testing.T) {
+	pools := openPools(t, 4)
+	primary := pools[0]
+	rs := NewReplicaSet(primary, map[string]*sql.DB{"a": pools[1], "b": pools[2], "c": pools[3]})
+	ctx := context.Background()
+
+	// Reads go to every replica in turn.
+	seen := make(map[DBTX]int)
+	for i := 0; i < 6; i++ {
+		seen[rs.reader(ctx)]++
+	}
+	for i, replica := range pools[1:] {
+		if seen[replica] != 2 {
+			t.Errorf("got %d reads on replica %d; want 2", seen[replica], i+1)
+		}
+	}
+	if seen[primary] != 0 {
+		t.Errorf("got %d reads on the primary; want 0", seen[primary])
+	}
+
+	if got := rs.reader(WithPrimary(ctx)); got != primary {
+		t.Error("got a replica for a WithPrimary context; want the primary")
+	}
+
+	// A replica which fails its health check is skipped.
+	pools[2].Close()
+	rs.checkHealth(time.Second)
+	for i := 0; i < 6; i++ {
+		if rs.reader(ctx) == pools[2] {
+			t.Fatal("got the unhealthy replica")
+		}
+	}
+	for _, stats := range rs.Stats()["replicas"].([]map[string]any) {
+		wantHealthy := stats["name"] != "b"
+		if stats["healthy"] != wantHealthy || (stats["last_error"] != "") == wantHealthy {
+			t.Errorf("got replica stats %v", stats)
+		}
+	}
+
+	// Once every replica is down, reads fall back to the primary.
+	pools[1].Close()
+	pools[3].Close()
+	rs.checkHealth(time.Second)
+	if got := rs.reader(ctx); got != primary {
+		t.Error("got a replica while every replica is down; want the primary")
+	}
+}
+
+func TestReplicaSetWithoutReplicas(t *testing.T) {
+	primary := openPools(t, 1)[0]
+	rs := NewReplicaSet(primary, nil)
+
+	if got := rs.reader(context.Background()); got != primary {
+		t.Error("got a replica; want the primary")
+	}
+}
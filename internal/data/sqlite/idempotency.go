@@ -0,0 +1,112 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"time"
+)
+
+type IdempotencyKeyModel struct {
+	DB           data.DBTX
+	QueryTimeout time.Duration
+}
+
+func (m IdempotencyKeyModel) Reserve(ctx context.Context, key *data.IdempotencyKey) (*data.IdempotencyKey, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, user_id, request_hash, expiry)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = excluded.request_hash, status = NULL, header = NULL, body = NULL, expiry = excluded.expiry
+		WHERE idempotency_keys.expiry <= ?
+		RETURNING key`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+
+	var claimed string
+	err := m.DB.QueryRowContext(ctx, query, key.Key, key.UserID, key.RequestHash, key.Expiry.Unix(), now).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, queryError(ctx, err)
+	}
+
+	query = `
+		SELECT request_hash, COALESCE(status, 0), header, body, expiry
+		FROM idempotency_keys
+		WHERE user_id = ? AND key = ?`
+
+	existing := data.IdempotencyKey{Key: key.Key, UserID: key.UserID}
+	var (
+		header sql.NullString
+		expiry int64
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, key.UserID, key.Key).Scan(
+		&existing.RequestHash,
+		&existing.Status,
+		&header,
+		&existing.Body,
+		&expiry,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, data.ErrEditConflict
+		}
+		return nil, queryError(ctx, err)
+	}
+
+	existing.Expiry = time.Unix(expiry, 0)
+	if header.Valid {
+		err = json.Unmarshal([]byte(header.String), &existing.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &existing, nil
+}
+
+func (m IdempotencyKeyModel) Complete(ctx context.Context, key *data.IdempotencyKey) error {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = ?, header = ?, body = ?, expiry = ?
+		WHERE user_id = ? AND key = ?`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, key.Status, string(header), key.Body, key.Expiry.Unix(), key.UserID, key.Key)
+	return queryError(ctx, err)
+}
+
+func (m IdempotencyKeyModel) Release(ctx context.Context, userID int64, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND status IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return queryError(ctx, err)
+}
+
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context) error {
+	query := `DELETE FROM idempotency_keys WHERE expiry <= ?`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now().Unix())
+	return queryError(ctx, err)
+}
@@ -0,0 +1,260 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"time"
+)
+
+type MovieModel struct {
+	DB           data.DBTX
+	QueryTimeout time.Duration
+}
+
+const movieColumns = `
+	id, created_at, title, year, runtime,
+	(SELECT json_group_array(genre) FROM (SELECT genre FROM movie_genres WHERE movie_id = movies.id ORDER BY position)),
+	synopsis, rating, release_date, original_language, version`
+
+func insertGenres(ctx context.Context, q data.DBTX, movieID int64, genres []string) error {
+	for i, genre := range genres {
+		_, err := q.ExecContext(ctx, `INSERT INTO movie_genres (movie_id, position, genre) VALUES (?, ?, ?)`, movieID, i, genre)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+	query := `
+			INSERT INTO movies (title, year, runtime, synopsis, rating, release_date, original_language)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			RETURNING id, created_at, version
+			`
+
+	args := []any{
+		movie.Title,
+		movie.Year,
+		movie.RunTime,
+		movie.Synopsis,
+		movie.Rating,
+		dateArg(movie.ReleaseDate),
+		movie.OriginalLanguage,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := atomically(ctx, m.DB, func(q data.DBTX) error {
+		err := q.QueryRowContext(ctx, query, args...).Scan(&movie.ID, timestamp{&movie.CreatedAt}, &movie.Version)
+		if err != nil {
+			return err
+		}
+
+		return insertGenres(ctx, q, movie.ID, movie.Genres)
+	})
+
+	return queryError(ctx, err)
+}
+
+func (m *MovieModel) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	if id < 1 {
+		return nil, data.ErrRecordNotFound
+	}
+	query := `SELECT ` + movieColumns + ` FROM movies WHERE id = ?`
+
+	var movie data.Movie
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		timestamp{&movie.CreatedAt},
+		&movie.Title,
+		&movie.Year,
+		&movie.RunTime,
+		genreList{&movie.Genres},
+		&movie.Synopsis,
+		&movie.Rating,
+		&movie.ReleaseDate,
+		&movie.OriginalLanguage,
+		&movie.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+
+	return &movie, nil
+}
+
+func (m *MovieModel) Update(ctx context.Context, movie *data.Movie) error {
+	query := `
+			UPDATE movies SET title = ?, year = ?, runtime = ?, synopsis = ?, rating = ?, release_date = ?,
+			original_language = ?, version = version + 1
+			WHERE id = ? AND version = ? RETURNING version
+			`
+
+	args := []any{
+		movie.Title,
+		movie.Year,
+		movie.RunTime,
+		movie.Synopsis,
+		movie.Rating,
+		dateArg(movie.ReleaseDate),
+		movie.OriginalLanguage,
+		movie.ID,
+		movie.Version,
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := atomically(ctx, m.DB, func(q data.DBTX) error {
+		err := q.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.ExecContext(ctx, `DELETE FROM movie_genres WHERE movie_id = ?`, movie.ID)
+		if err != nil {
+			return err
+		}
+
+		return insertGenres(ctx, q, movie.ID, movie.Genres)
+	})
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return data.ErrEditConflict
+		default:
+			return queryError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (m *MovieModel) Delete(ctx context.Context, id int64, version int32) error {
+	if id < 1 {
+		return data.ErrRecordNotFound
+	}
+
+	query := `DELETE FROM movies WHERE id = ? AND (? = 0 OR version = ?)`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, version, version)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		if version == 0 {
+			return data.ErrRecordNotFound
+		}
+
+		var exists bool
+		err = m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = ?)`, id).Scan(&exists)
+		if err != nil {
+			return queryError(ctx, err)
+		}
+		if !exists {
+			return data.ErrRecordNotFound
+		}
+		return data.ErrEditConflict
+	}
+
+	return nil
+}
+
+func (m *MovieModel) GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore data.Date, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	// Match PostgreSQL, which sorts NULLs as if they were larger than any other value.
+	nulls := "NULLS LAST"
+	if filters.SortDirection() == "DESC" {
+		nulls = "NULLS FIRST"
+	}
+
+	query := fmt.Sprintf(
+		`
+				SELECT COUNT(*) OVER(), %s
+				FROM movies
+				WHERE (?1 = '' OR id IN (SELECT rowid FROM movies_fts WHERE movies_fts MATCH ?1))
+				AND NOT EXISTS (
+					SELECT 1 FROM json_each(?2)
+					WHERE value NOT IN (SELECT genre FROM movie_genres WHERE movie_id = movies.id)
+				)
+				AND (rating = ?3 OR ?3 = '')
+				AND (release_date >= ?4 OR ?4 IS NULL)
+				AND (release_date <= ?5 OR ?5 IS NULL)
+				ORDER BY %s %s %s, id ASC
+				LIMIT ?6 OFFSET ?7
+			`, movieColumns, filters.SortColumn(), filters.SortDirection(), nulls,
+	)
+
+	genresJSON, err := json.Marshal(genres)
+	if err != nil {
+		return nil, data.Metadata{}, err
+	}
+
+	args := []any{
+		ftsQuery(title),
+		string(genresJSON),
+		rating,
+		dateArg(releasedAfter),
+		dateArg(releasedBefore),
+		filters.Limit(),
+		filters.Offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, data.Metadata{}, queryError(ctx, err)
+	}
+
+	defer rows.Close()
+	totalRecords := 0
+	movies := []*data.Movie{}
+	for rows.Next() {
+		var movie data.Movie
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			timestamp{&movie.CreatedAt},
+			&movie.Title,
+			&movie.Year,
+			&movie.RunTime,
+			genreList{&movie.Genres},
+			&movie.Synopsis,
+			&movie.Rating,
+			&movie.ReleaseDate,
+			&movie.OriginalLanguage,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, data.Metadata{}, queryError(ctx, err)
+	}
+
+	metadata := data.CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return movies, metadata, nil
+}
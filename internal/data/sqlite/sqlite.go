@@ -0,0 +1,196 @@
+// Package sqlite implements data.Models on top of an SQLite database, so Greenlight can run
+// on a single node without a separate database server. Genres are kept in a join table and
+// titles are searched through an FTS5 index; see migrations/sqlite for the schema.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Scheme is the DSN scheme which selects the SQLite backend, as in "sqlite://greenlight.db".
+const Scheme = "sqlite"
+
+// DataSourceName converts a "sqlite://path/to/file.db" DSN into the data source name expected
+// by the modernc.org/sqlite driver, enabling foreign keys, a busy timeout and WAL mode on
+// every connection in the pool.
+func DataSourceName(dsn string) (string, error) {
+	path := strings.TrimPrefix(dsn, Scheme+"://")
+	if path == dsn || path == "" {
+		return "", fmt.Errorf("invalid SQLite DSN %q, expected %s://path/to/file.db", dsn, Scheme)
+	}
+
+	query := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	pragmas := "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	if query != "" {
+		pragmas += "&" + query
+	}
+
+	return "file:" + path + "?" + pragmas, nil
+}
+
+// NewModels returns the SQLite backed models. Every query is bounded by queryTimeout on top
+// of whatever deadline or cancellation the caller's context already carries.
+func NewModels(db *sql.DB, queryTimeout time.Duration) data.Models {
+	m := newModels(db, queryTimeout)
+	m.Transactor = &transactor{db: db, queryTimeout: queryTimeout}
+	return m
+}
+
+func newModels(db data.DBTX, queryTimeout time.Duration) data.Models {
+	return data.Models{
+		Movies: &MovieModel{DB: db, QueryTimeout: queryTimeout},
+		Users:  UserModel{DB: db, QueryTimeout: queryTimeout},
+		Tokens: TokenModel{DB: db, QueryTimeout: queryTimeout},
+
+		IdempotencyKeys: IdempotencyKeyModel{DB: db, QueryTimeout: queryTimeout},
+	}
+}
+
+type transactor struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+func (t *transactor) WithTx(ctx context.Context, fn func(tx data.Models) error) (err error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(newModels(tx, t.queryTimeout))
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %s)", err, rollbackErr)
+		}
+		return err
+	}
+
+	return queryError(ctx, tx.Commit())
+}
+
+// atomically runs fn inside a transaction of its own, unless db is already a transaction in
+// which case fn simply becomes part of it.
+func atomically(ctx context.Context, db data.DBTX, fn func(q data.DBTX) error) error {
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// queryError makes sure a query which failed because its context was cancelled or timed out
+// can be detected with errors.Is(err, context.DeadlineExceeded) or context.Canceled.
+func queryError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+	return err
+}
+
+// timestamp scans the TEXT values SQLite stores for CURRENT_TIMESTAMP columns into a time.Time.
+type timestamp struct {
+	t *time.Time
+}
+
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999-07:00",
+	time.RFC3339Nano,
+}
+
+func (ts timestamp) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		*ts.t = v
+		return nil
+	case []byte:
+		return ts.Scan(string(v))
+	case string:
+		for _, layout := range timestampLayouts {
+			t, err := time.Parse(layout, v)
+			if err == nil {
+				*ts.t = t
+				return nil
+			}
+		}
+		return fmt.Errorf("cannot parse %q as a timestamp", v)
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
+	}
+}
+
+// genreList scans the JSON array produced by json_group_array() into a slice of genres.
+type genreList struct {
+	genres *[]string
+}
+
+func (g genreList) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into genres", src)
+	}
+
+	*g.genres = []string{}
+	return json.Unmarshal(b, g.genres)
+}
+
+// dateArg converts a data.Date into the "YYYY-MM-DD" text the schema stores, or NULL.
+func dateArg(d data.Date) any {
+	if d.IsZero() {
+		return nil
+	}
+	return d.String()
+}
+
+// ftsQuery turns free text into an FTS5 query which, like PostgreSQL's plainto_tsquery,
+// matches titles containing every word. It returns "" when there is nothing to search for.
+func ftsQuery(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, word := range words {
+		words[i] = `"` + word + `"`
+	}
+
+	return strings.Join(words, " ")
+}
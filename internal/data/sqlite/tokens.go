@@ -0,0 +1,41 @@
+package sqlite
+
+import (
+	"context"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"time"
+)
+
+type TokenModel struct {
+	DB           data.DBTX
+	QueryTimeout time.Duration
+}
+
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	token, err := data.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m TokenModel) Insert(ctx context.Context, token *data.Token) error {
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope) VALUES (?, ?, ?, ?)`
+	args := []any{token.Hash, token.UserID, token.Expiry.Unix(), token.Scope}
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, args...)
+
+	return queryError(ctx, err)
+}
+
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	query := `DELETE FROM tokens WHERE scope = ? AND user_id = ?`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+
+	return queryError(ctx, err)
+}
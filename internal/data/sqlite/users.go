@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"strings"
+	"time"
+)
+
+type UserModel struct {
+	DB           data.DBTX
+	QueryTimeout time.Duration
+}
+
+func isDuplicateEmail(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: users.email")
+}
+
+func (m UserModel) Insert(ctx context.Context, user *data.User) error {
+	query := `
+				INSERT INTO users (name, email, password_hash, activated)
+				VALUES (?, ?, ?, ?)
+				RETURNING id, created_at, version
+			`
+
+	args := []any{user.Name, user.Email, user.Password, user.Activated}
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, timestamp{&user.CreatedAt}, &user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return data.ErrDuplicateEmail
+		default:
+			return queryError(ctx, err)
+		}
+	}
+
+	return nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	query := `
+				SELECT id, created_at, name, email, password_hash, activated, version FROM users
+				WHERE email = ?
+			`
+	var user data.User
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&user.ID,
+		timestamp{&user.CreatedAt}, &user.Name, &user.Email, &user.Password, &user.Activated, &user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+	return &user, nil
+}
+
+func (m UserModel) Update(ctx context.Context, user *data.User) error {
+	query := ` UPDATE users
+				SET name = ?, email = ?, password_hash = ?, activated = ?, version = version + 1 WHERE id = ? AND version = ?
+				RETURNING version
+			 `
+
+	args := []any{user.Name,
+		user.Email, user.Password, user.Activated, user.ID, user.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return data.ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return data.ErrEditConflict
+		default:
+			return queryError(ctx, err)
+		}
+	}
+
+	return nil
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+			SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version FROM users
+			INNER JOIN tokens
+			ON users.id = tokens.user_id
+			WHERE tokens.hash = ?
+			AND tokens.scope = ?
+			AND tokens.expiry > ?
+			`
+
+	args := []any{tokenHash[:], tokenScope, time.Now().Unix()}
+	var user data.User
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		timestamp{&user.CreatedAt},
+		&user.Name,
+		&user.Email,
+		&user.Password,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, queryError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
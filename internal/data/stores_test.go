@@ -0,0 +1,379 @@
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/data"
+	"github.com/danyelkeddah/go-greenlight/internal/data/memory"
+	"github.com/danyelkeddah/go-greenlight/internal/data/sqlite"
+	"github.com/danyelkeddah/go-greenlight/migrations"
+	"golang.org/x/crypto/bcrypt"
+	"io/fs"
+	_ "modernc.org/sqlite"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	data.PasswordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// backends returns a constructor for fresh, empty models of every backend which runs without
+// a server, so the same suite keeps them in agreement.
+func backends() map[string]func(t *testing.T) data.Models {
+	return map[string]func(t *testing.T) data.Models{
+		"memory": func(t *testing.T) data.Models { return memory.New() },
+		"sqlite": openSQLite,
+	}
+}
+
+// openSQLite returns models backed by a new SQLite database in a temporary file, with every
+// embedded SQLite migration applied.
+func openSQLite(t *testing.T) data.Models {
+	t.Helper()
+
+	dsn, err := sqlite.DataSourceName(sqlite.Scheme + "://" + filepath.Join(t.TempDir(), "greenlight.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	files, err := fs.Glob(migrations.FS, path.Join(migrations.SQLiteDir, "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		script, err := fs.ReadFile(migrations.FS, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(script)); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+	}
+
+	return sqlite.NewModels(db, 5*time.Second)
+}
+
+// runStores runs test against every backend.
+func runStores(t *testing.T, test func(t *testing.T, ctx context.Context, models data.Models)) {
+	for name, open := range backends() {
+		t.Run(name, func(t *testing.T) {
+			test(t, context.Background(), open(t))
+		})
+	}
+}
+
+func insertMovie(t *testing.T, ctx context.Context, models data.Models, title string, genres ...string) *data.Movie {
+	t.Helper()
+
+	movie := &data.Movie{Title: title, Year: 1999, RunTime: 120, Genres: genres, Rating: "R", OriginalLanguage: "en"}
+	if err := models.Movies.Insert(ctx, movie); err != nil {
+		t.Fatal(err)
+	}
+	return movie
+}
+
+func newUser(t *testing.T, ctx context.Context, name, email string) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: name, Email: email, Activated: true}
+	if err := user.Password.Set(ctx, "pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func titles(movies []*data.Movie) []string {
+	titles := []string{}
+	for _, movie := range movies {
+		titles = append(titles, movie.Title)
+	}
+	return titles
+}
+
+func TestMovieStore(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, models data.Models) {
+		fight := insertMovie(t, ctx, models, "Fight Club", "drama", "thriller")
+		insertMovie(t, ctx, models, "The Club", "comedy")
+		insertMovie(t, ctx, models, "The Matrix", "action", "sci-fi")
+
+		got, err := models.Movies.Get(ctx, fight.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "Fight Club" || got.Version != 1 || !reflect.DeepEqual(got.Genres, []string{"drama", "thriller"}) {
+			t.Errorf("got movie %+v", got)
+		}
+		if _, err := models.Movies.Get(ctx, 999); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got error %v for a missing movie; want ErrRecordNotFound", err)
+		}
+
+		tests := []struct {
+			name   string
+			title  string
+			genres []string
+			want   []string
+		}{
+			{"all", "", nil, []string{"Fight Club", "The Club", "The Matrix"}},
+			// Titles must contain every word searched for, in any case and order.
+			{"one word", "club", nil, []string{"Fight Club", "The Club"}},
+			{"every word", "CLUB fight", nil, []string{"Fight Club"}},
+			{"punctuation", "club!", nil, []string{"Fight Club", "The Club"}},
+			// Movies must have every genre filtered on.
+			{"genre", "", []string{"thriller"}, []string{"Fight Club"}},
+			{"every genre", "", []string{"action", "drama"}, []string{}},
+			{"title and genre", "the", []string{"comedy"}, []string{"The Club"}},
+		}
+		for _, tt := range tests {
+			movies, metadata, err := models.Movies.GetAll(ctx, tt.title, tt.genres, "", data.Date{}, data.Date{}, data.Filters{
+				Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"},
+			})
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if got := titles(movies); !reflect.DeepEqual(got, tt.want) || metadata.TotalRecords != len(tt.want) {
+				t.Errorf("%s: got %q with %d records; want %q", tt.name, got, metadata.TotalRecords, tt.want)
+			}
+		}
+
+		// Replacing the genres keeps them in the order given.
+		stale := *got
+		got.Title = "Fight Club (1999)"
+		got.Genres = []string{"thriller", "cult"}
+		if err := models.Movies.Update(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		updated, err := models.Movies.Get(ctx, fight.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Version != 2 || updated.Title != "Fight Club (1999)" || !reflect.DeepEqual(updated.Genres, []string{"thriller", "cult"}) {
+			t.Errorf("got updated movie %+v", updated)
+		}
+
+		// The search index follows the new title.
+		movies, _, err := models.Movies.GetAll(ctx, "1999", nil, "", data.Date{}, data.Date{}, data.Filters{
+			Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := titles(movies); !reflect.DeepEqual(got, []string{"Fight Club (1999)"}) {
+			t.Errorf("got %q searching the new title", got)
+		}
+
+		if err := models.Movies.Update(ctx, &stale); !errors.Is(err, data.ErrEditConflict) {
+			t.Errorf("got error %v updating a stale version; want ErrEditConflict", err)
+		}
+		if err := models.Movies.Delete(ctx, fight.ID, 1); !errors.Is(err, data.ErrEditConflict) {
+			t.Errorf("got error %v deleting a stale version; want ErrEditConflict", err)
+		}
+		if err := models.Movies.Delete(ctx, fight.ID, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Movies.Delete(ctx, fight.ID, 0); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got error %v deleting a deleted movie; want ErrRecordNotFound", err)
+		}
+	})
+}
+
+func TestUserStore(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, models data.Models) {
+		alice := newUser(t, ctx, "Alice", "alice@example.com")
+		if err := models.Users.Insert(ctx, alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Users.Insert(ctx, newUser(t, ctx, "Impostor", "alice@example.com")); !errors.Is(err, data.ErrDuplicateEmail) {
+			t.Errorf("got error %v inserting a duplicate email; want ErrDuplicateEmail", err)
+		}
+
+		bob := newUser(t, ctx, "Bob", "bob@example.com")
+		if err := models.Users.Insert(ctx, bob); err != nil {
+			t.Fatal(err)
+		}
+		bob.Email = "alice@example.com"
+		if err := models.Users.Update(ctx, bob); !errors.Is(err, data.ErrDuplicateEmail) {
+			t.Errorf("got error %v updating to a duplicate email; want ErrDuplicateEmail", err)
+		}
+
+		got, err := models.Users.GetByEmail(ctx, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != alice.ID || got.Name != "Alice" || !got.Activated {
+			t.Errorf("got user %+v", got)
+		}
+		if matches, err := got.Password.Matches(ctx, "pa55word"); err != nil || !matches {
+			t.Errorf("got password match %t, %v", matches, err)
+		}
+		if _, err := models.Users.GetByEmail(ctx, "carol@example.com"); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got error %v for a missing user; want ErrRecordNotFound", err)
+		}
+
+		stale := *got
+		got.Name = "Alice Liddell"
+		if err := models.Users.Update(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := models.Users.Update(ctx, &stale); !errors.Is(err, data.ErrEditConflict) {
+			t.Errorf("got error %v updating a stale version; want ErrEditConflict", err)
+		}
+	})
+}
+
+func TestTokenStore(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, models data.Models) {
+		alice := newUser(t, ctx, "Alice", "alice@example.com")
+		if err := models.Users.Insert(ctx, alice); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := models.Tokens.New(ctx, alice.ID, time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired, err := models.Tokens.New(ctx, alice.ID, -time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := models.Users.GetForToken(ctx, data.ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != alice.ID {
+			t.Errorf("got user %d for the token; want %d", got.ID, alice.ID)
+		}
+		for name, lookup := range map[string][2]string{
+			"expired":     {data.ScopeAuthentication, expired.Plaintext},
+			"other scope": {data.ScopeActivation, token.Plaintext},
+		} {
+			if _, err := models.Users.GetForToken(ctx, lookup[0], lookup[1]); !errors.Is(err, data.ErrRecordNotFound) {
+				t.Errorf("%s: got error %v; want ErrRecordNotFound", name, err)
+			}
+		}
+
+		if err := models.Tokens.DeleteAllForUser(ctx, data.ScopeAuthentication, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.GetForToken(ctx, data.ScopeAuthentication, token.Plaintext); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got error %v for a deleted token; want ErrRecordNotFound", err)
+		}
+	})
+}
+
+func TestIdempotencyKeyStore(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, models data.Models) {
+		keys := models.IdempotencyKeys
+		// Expiries are whole seconds, as SQLite stores unix timestamps.
+		expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+		key := &data.IdempotencyKey{Key: "k1", UserID: 1, RequestHash: []byte("hash"), Expiry: expiry}
+
+		existing, err := keys.Reserve(ctx, key)
+		if err != nil || existing != nil {
+			t.Fatalf("got %+v, %v reserving a new key", existing, err)
+		}
+
+		// A retry while the request is in progress sees it hasn't finished.
+		existing, err = keys.Reserve(ctx, key)
+		if err != nil || existing == nil || existing.Status != 0 || string(existing.RequestHash) != "hash" {
+			t.Fatalf("got %+v, %v reserving an in-progress key", existing, err)
+		}
+
+		// Keys are scoped to their user.
+		other := *key
+		other.UserID = 2
+		if existing, err := keys.Reserve(ctx, &other); err != nil || existing != nil {
+			t.Errorf("got %+v, %v reserving another user's key", existing, err)
+		}
+
+		completed := *key
+		completed.Status = 201
+		completed.Header = map[string]string{"Location": "/v1/movies/1"}
+		completed.Body = []byte(`{"movie": {}}`)
+		if err := keys.Complete(ctx, &completed); err != nil {
+			t.Fatal(err)
+		}
+		// Only keys still in progress are released.
+		if err := keys.Release(ctx, key.UserID, key.Key); err != nil {
+			t.Fatal(err)
+		}
+
+		existing, err = keys.Reserve(ctx, key)
+		if err != nil || existing == nil {
+			t.Fatalf("got %+v, %v reserving a completed key", existing, err)
+		}
+		if existing.Status != 201 || existing.Header["Location"] != "/v1/movies/1" || string(existing.Body) != `{"movie": {}}` || !existing.Expiry.Equal(expiry) {
+			t.Errorf("got completed key %+v", existing)
+		}
+
+		if err := keys.Release(ctx, other.UserID, other.Key); err != nil {
+			t.Fatal(err)
+		}
+		if existing, err := keys.Reserve(ctx, &other); err != nil || existing != nil {
+			t.Errorf("got %+v, %v reserving a released key", existing, err)
+		}
+
+		// An expired key is replaced by the next request, and purged.
+		lapsed := &data.IdempotencyKey{Key: "k2", UserID: 1, RequestHash: []byte("old"), Expiry: time.Now().Add(-time.Minute)}
+		if _, err := keys.Reserve(ctx, lapsed); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.DeleteExpired(ctx); err != nil {
+			t.Fatal(err)
+		}
+		renewed := &data.IdempotencyKey{Key: "k2", UserID: 1, RequestHash: []byte("new"), Expiry: expiry}
+		if existing, err := keys.Reserve(ctx, renewed); err != nil || existing != nil {
+			t.Errorf("got %+v, %v reserving an expired key", existing, err)
+		}
+		if _, err := keys.Reserve(ctx, lapsed); err != nil {
+			t.Fatal(err)
+		}
+		existing, err = keys.Reserve(ctx, renewed)
+		if err != nil || existing == nil || string(existing.RequestHash) != "new" {
+			t.Errorf("got %+v, %v; want the renewed key", existing, err)
+		}
+	})
+}
+
+func TestWithTx(t *testing.T) {
+	runStores(t, func(t *testing.T, ctx context.Context, models data.Models) {
+		errAbort := errors.New("abort")
+
+		err := models.Transactor.WithTx(ctx, func(tx data.Models) error {
+			if err := tx.Users.Insert(ctx, newUser(t, ctx, "Alice", "alice@example.com")); err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) {
+			t.Fatalf("got error %v; want the error returned by fn", err)
+		}
+		if _, err := models.Users.GetByEmail(ctx, "alice@example.com"); !errors.Is(err, data.ErrRecordNotFound) {
+			t.Errorf("got error %v after rollback; want ErrRecordNotFound", err)
+		}
+
+		err = models.Transactor.WithTx(ctx, func(tx data.Models) error {
+			return tx.Users.Insert(ctx, newUser(t, ctx, "Alice", "alice@example.com"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.Users.GetByEmail(ctx, "alice@example.com"); err != nil {
+			t.Errorf("got error %v after commit", err)
+		}
+	})
+}
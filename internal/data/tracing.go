@@ -0,0 +1,190 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
+	"time"
+)
+
+// Traced returns a copy of models which records a span for every call to its stores, named
+// after the model and method, such as MovieModel.Get. The spans are children of the span the
+// caller's context carries, so nothing is recorded for calls made outside a traced request.
+// Transactions are recorded as a span of their own, and the models bound to them are traced
+// as well.
+func Traced(models Models) Models {
+	models.Movies = tracedMovies{store: models.Movies}
+	models.Users = tracedUsers{store: models.Users}
+	models.Tokens = tracedTokens{store: models.Tokens}
+	if models.IdempotencyKeys != nil {
+		models.IdempotencyKeys = tracedIdempotencyKeys{store: models.IdempotencyKeys}
+	}
+	if models.Transactor != nil {
+		models.Transactor = tracedTransactor{transactor: models.Transactor}
+	}
+	return models
+}
+
+func startQuery(ctx context.Context, name string, attributes ...trace.Attribute) (context.Context, *trace.Span) {
+	return trace.Start(ctx, name, trace.KindClient, attributes...)
+}
+
+// endQuery finishes the span of a call. A missing record is an answer rather than a failure,
+// so it is recorded as an attribute instead of an error.
+func endQuery(span *trace.Span, err error) {
+	if errors.Is(err, ErrRecordNotFound) {
+		span.SetAttributes(trace.Bool("db.record_found", false))
+	} else {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+type tracedMovies struct {
+	store MovieStore
+}
+
+func (m tracedMovies) Insert(ctx context.Context, movie *Movie) error {
+	ctx, span := startQuery(ctx, "MovieModel.Insert")
+	err := m.store.Insert(ctx, movie)
+	span.SetAttributes(trace.Int64("movie.id", movie.ID))
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedMovies) Get(ctx context.Context, id int64) (*Movie, error) {
+	ctx, span := startQuery(ctx, "MovieModel.Get", trace.Int64("movie.id", id))
+	movie, err := m.store.Get(ctx, id)
+	endQuery(span, err)
+	return movie, err
+}
+
+func (m tracedMovies) GetAll(ctx context.Context, title string, genres []string, rating string, releasedAfter, releasedBefore Date, filters Filters) ([]*Movie, Metadata, error) {
+	ctx, span := startQuery(ctx, "MovieModel.GetAll",
+		trace.Int("filters.page", filters.Page),
+		trace.Int("filters.page_size", filters.PageSize),
+		trace.String("filters.sort", filters.Sort),
+	)
+	movies, metadata, err := m.store.GetAll(ctx, title, genres, rating, releasedAfter, releasedBefore, filters)
+	span.SetAttributes(trace.Int("db.rows", len(movies)))
+	endQuery(span, err)
+	return movies, metadata, err
+}
+
+func (m tracedMovies) Update(ctx context.Context, movie *Movie) error {
+	ctx, span := startQuery(ctx, "MovieModel.Update", trace.Int64("movie.id", movie.ID))
+	err := m.store.Update(ctx, movie)
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedMovies) Delete(ctx context.Context, id int64, version int32) error {
+	ctx, span := startQuery(ctx, "MovieModel.Delete", trace.Int64("movie.id", id))
+	err := m.store.Delete(ctx, id, version)
+	endQuery(span, err)
+	return err
+}
+
+type tracedUsers struct {
+	store UserStore
+}
+
+func (m tracedUsers) Insert(ctx context.Context, user *User) error {
+	ctx, span := startQuery(ctx, "UserModel.Insert")
+	err := m.store.Insert(ctx, user)
+	span.SetAttributes(trace.Int64("user.id", user.ID))
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedUsers) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, span := startQuery(ctx, "UserModel.GetByEmail")
+	user, err := m.store.GetByEmail(ctx, email)
+	endQuery(span, err)
+	return user, err
+}
+
+func (m tracedUsers) Update(ctx context.Context, user *User) error {
+	ctx, span := startQuery(ctx, "UserModel.Update", trace.Int64("user.id", user.ID))
+	err := m.store.Update(ctx, user)
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedUsers) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	ctx, span := startQuery(ctx, "UserModel.GetForToken", trace.String("token.scope", tokenScope))
+	user, err := m.store.GetForToken(ctx, tokenScope, tokenPlaintext)
+	endQuery(span, err)
+	return user, err
+}
+
+type tracedTokens struct {
+	store TokenStore
+}
+
+func (m tracedTokens) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	ctx, span := startQuery(ctx, "TokenModel.New", trace.Int64("user.id", userID), trace.String("token.scope", scope))
+	token, err := m.store.New(ctx, userID, ttl, scope)
+	endQuery(span, err)
+	return token, err
+}
+
+func (m tracedTokens) Insert(ctx context.Context, token *Token) error {
+	ctx, span := startQuery(ctx, "TokenModel.Insert", trace.Int64("user.id", token.UserID), trace.String("token.scope", token.Scope))
+	err := m.store.Insert(ctx, token)
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedTokens) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	ctx, span := startQuery(ctx, "TokenModel.DeleteAllForUser", trace.Int64("user.id", userID), trace.String("token.scope", scope))
+	err := m.store.DeleteAllForUser(ctx, scope, userID)
+	endQuery(span, err)
+	return err
+}
+
+type tracedIdempotencyKeys struct {
+	store IdempotencyKeyStore
+}
+
+func (m tracedIdempotencyKeys) Reserve(ctx context.Context, key *IdempotencyKey) (*IdempotencyKey, error) {
+	ctx, span := startQuery(ctx, "IdempotencyKeyModel.Reserve")
+	existing, err := m.store.Reserve(ctx, key)
+	endQuery(span, err)
+	return existing, err
+}
+
+func (m tracedIdempotencyKeys) Complete(ctx context.Context, key *IdempotencyKey) error {
+	ctx, span := startQuery(ctx, "IdempotencyKeyModel.Complete")
+	err := m.store.Complete(ctx, key)
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedIdempotencyKeys) Release(ctx context.Context, userID int64, key string) error {
+	ctx, span := startQuery(ctx, "IdempotencyKeyModel.Release", trace.Int64("user.id", userID))
+	err := m.store.Release(ctx, userID, key)
+	endQuery(span, err)
+	return err
+}
+
+func (m tracedIdempotencyKeys) DeleteExpired(ctx context.Context) error {
+	ctx, span := startQuery(ctx, "IdempotencyKeyModel.DeleteExpired")
+	err := m.store.DeleteExpired(ctx)
+	endQuery(span, err)
+	return err
+}
+
+type tracedTransactor struct {
+	transactor Transactor
+}
+
+// WithTx records the transaction as a span, from its start to its commit or rollback.
+func (t tracedTransactor) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	ctx, span := startQuery(ctx, "Models.WithTx")
+	err := t.transactor.WithTx(ctx, func(tx Models) error {
+		return fn(Traced(tx))
+	})
+	endQuery(span, err)
+	return err
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
 	"github.com/danyelkeddah/go-greenlight/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 	"time"
@@ -34,9 +37,19 @@ type password struct {
 	hash      []byte
 }
 
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+// PasswordCost is the bcrypt cost of new password hashes. Tests lower it to bcrypt.MinCost,
+// as hashing at the production cost makes every fixture user take a noticeable time.
+var PasswordCost = 12
+
+// Set hashes the password, which is deliberately slow, so the time taken is recorded as a
+// span of the request ctx belongs to.
+func (p *password) Set(ctx context.Context, plaintextPassword string) error {
+	_, span := trace.Start(ctx, "password.Set", trace.KindInternal, trace.Int("bcrypt.cost", PasswordCost))
+	defer span.End()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), PasswordCost)
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
@@ -46,19 +59,42 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
-func (p *password) Matches(plaintextPassword string) (bool, error) {
+func (p *password) Matches(ctx context.Context, plaintextPassword string) (bool, error) {
+	_, span := trace.Start(ctx, "password.Matches", trace.KindInternal)
+	defer span.End()
+
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
 	if err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
 			return false, nil
 		default:
+			span.RecordError(err)
 			return false, err
 		}
 	}
 	return true, nil
 }
 
+// Scan implements the sql.Scanner interface, loading a stored bcrypt hash into the password.
+func (p *password) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		p.hash = append([]byte(nil), v...)
+	case string:
+		p.hash = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into password", src)
+	}
+	p.plaintext = nil
+	return nil
+}
+
+// Value implements the driver.Valuer interface, so only the bcrypt hash is ever stored.
+func (p password) Value() (driver.Value, error) {
+	return p.hash, nil
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
@@ -86,10 +122,21 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB           DBTX
+	QueryTimeout time.Duration
+	// Replicas, when set, serves GetByEmail. GetForToken always reads from the primary, as a
+	// token is typically used moments after it was created.
+	Replicas *ReplicaSet
+}
+
+func (m UserModel) reader(ctx context.Context) DBTX {
+	if m.Replicas == nil {
+		return m.DB
+	}
+	return m.Replicas.reader(ctx)
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 				INSERT INTO users (name, email, password_hash, activated) 
 				VALUES ($1, $2, $3, $4)
@@ -97,7 +144,7 @@ func (m UserModel) Insert(user *User) error {
 			`
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
@@ -106,23 +153,23 @@ func (m UserModel) Insert(user *User) error {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		default:
-			return err
+			return queryError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 				SELECT id, created_at, name, email, password_hash, activated, version FROM users
 				WHERE email = $1
 			`
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&user.ID,
+	err := m.reader(ctx).QueryRowContext(ctx, query, email).Scan(&user.ID,
 		&user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
 	)
 
@@ -131,13 +178,13 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
 	}
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := ` UPDATE users
 				SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1 WHERE id = $5 AND version = $6
 				RETURNING version
@@ -147,7 +194,7 @@ func (m UserModel) Update(user *User) error {
 		user.Email, user.Password.hash, user.Activated, user.ID, user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
@@ -158,14 +205,14 @@ func (m UserModel) Update(user *User) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return queryError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) { // Calculate the SHA-256 hash of the plaintext token provided by the client. // Remember that this returns a byte *array* with length 32, not a slice. tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) { // Calculate the SHA-256 hash of the plaintext token provided by the client. // Remember that this returns a byte *array* with length 32, not a slice. tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
@@ -179,7 +226,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -196,7 +243,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, queryError(ctx, err)
 		}
 	}
 
@@ -2,17 +2,23 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Level is the severity of an entry. The zero Level is LevelInfo.
 type Level int8
 
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
 	LevelError
 	LevelFatal
 	LevelOff
@@ -20,62 +26,173 @@ const (
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the level with the given name, in any case.
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelOff; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// MarshalText implements encoding.TextMarshaler, so a Level can be a command-line flag.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// settings are shared by a logger and every logger derived from it with With or Component,
+// so changing the level of one changes it for all of them, even while they are writing.
+type settings struct {
+	minLevel atomic.Int32
+	// Entries at traceLevel or above include the stack of the goroutine which wrote them.
+	traceLevel atomic.Int32
+	mu         sync.Mutex
+}
+
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out        io.Writer
+	properties map[string]any
+	settings   *settings
 }
 
+// New returns a logger writing the entries at minLevel or above to out. Stack traces are
+// captured for errors and above, until changed with SetStackTraceLevel.
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
+	l := &Logger{
 		out:      out,
-		minLevel: minLevel,
+		settings: &settings{},
 	}
+	l.settings.minLevel.Store(int32(minLevel))
+	l.settings.traceLevel.Store(int32(LevelError))
+	return l
 }
 
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+// Level returns the minimum level of the entries written.
+func (l *Logger) Level() Level {
+	return Level(l.settings.minLevel.Load())
+}
+
+// SetLevel changes the minimum level of the entries written, which is safe while entries
+// are being written from other goroutines.
+func (l *Logger) SetLevel(level Level) {
+	l.settings.minLevel.Store(int32(level))
+}
+
+// StackTraceLevel returns the level from which entries include a stack trace.
+func (l *Logger) StackTraceLevel() Level {
+	return Level(l.settings.traceLevel.Load())
+}
+
+// SetStackTraceLevel changes the level from which entries include a stack trace. LevelOff
+// turns stack traces off.
+func (l *Logger) SetStackTraceLevel(level Level) {
+	l.settings.traceLevel.Store(int32(level))
+}
+
+// With returns a logger which adds properties to every entry it writes, such as the ID of
+// the request being served. Properties passed to a single entry take precedence. The logger
+// shares its output and settings with l, so their entries never interleave.
+func (l *Logger) With(properties map[string]any) *Logger {
+	return &Logger{
+		out:        l.out,
+		properties: merge(l.properties, properties),
+		settings:   l.settings,
+	}
+}
+
+// Component returns a logger for a part of the application, such as the tracer, which adds
+// its name to every entry as the component property.
+func (l *Logger) Component(name string) *Logger {
+	return l.With(map[string]any{"component": name})
+}
+
+func (l *Logger) PrintDebug(message string, properties map[string]any) {
+	l.print(LevelDebug, message, properties)
+}
+
+func (l *Logger) PrintInfo(message string, properties map[string]any) {
 	l.print(LevelInfo, message, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintWarn(message string, properties map[string]any) {
+	l.print(LevelWarn, message, properties)
+}
+
+func (l *Logger) PrintError(err error, properties map[string]any) {
 	l.print(LevelError, err.Error(), properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties map[string]any) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1)
 }
 
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+// merge returns the properties of both maps, preferring those of override. It returns base
+// itself when there is nothing to add, as neither map is ever modified.
+func merge(base, override map[string]any) map[string]any {
+	if len(override) == 0 {
+		return base
+	}
+	if len(base) == 0 {
+		return override
+	}
+
+	merged := make(map[string]any, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+	return merged
+}
+
+func (l *Logger) print(level Level, message string, properties map[string]any) (int, error) {
+	if level < l.Level() {
 		return 0, nil
 	}
 
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: merge(l.properties, properties),
 	}
 
-	if level >= LevelError {
+	if level >= l.StackTraceLevel() {
 		aux.Trace = string(debug.Stack())
 	}
 	// will hold the actual log entry text
@@ -86,8 +203,8 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	if err != nil {
 		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
 	}
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.settings.mu.Lock()
+	defer l.settings.mu.Unlock()
 
 	return l.out.Write(append(line, '\n'))
 }
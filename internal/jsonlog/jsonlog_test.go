@@ -0,0 +1,150 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	Level      string         `json:"level"`
+	Message    string         `json:"message"`
+	Properties map[string]any `json:"properties"`
+	Trace      string         `json:"trace"`
+}
+
+func entries(t *testing.T, buf *bytes.Buffer) []entry {
+	t.Helper()
+
+	var entries []entry
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal, LevelOff} {
+		for _, name := range []string{level.String(), strings.ToLower(level.String())} {
+			got, err := ParseLevel(name)
+			if err != nil || got != level {
+				t.Errorf("got %s, %v parsing %q", got, err, name)
+			}
+
+			var unmarshalled Level
+			if err := unmarshalled.UnmarshalText([]byte(name)); err != nil || unmarshalled != level {
+				t.Errorf("got %s, %v unmarshalling %q", unmarshalled, err, name)
+			}
+		}
+
+		text, err := level.MarshalText()
+		if err != nil || string(text) != level.String() {
+			t.Errorf("got %q, %v marshalling %s", text, err, level)
+		}
+	}
+
+	for _, name := range []string{"", "verbose", "WARNING"} {
+		if _, err := ParseLevel(name); err == nil {
+			t.Errorf("got no error parsing %q", name)
+		}
+		level := LevelError
+		if err := level.UnmarshalText([]byte(name)); err == nil || level != LevelError {
+			t.Errorf("got %s, %v unmarshalling %q", level, err, name)
+		}
+	}
+
+	var zero Level
+	if zero != LevelInfo {
+		t.Errorf("got zero level %s; want INFO", zero)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelWarn)
+	child := logger.With(map[string]any{"request_id": "abc-123"})
+	component := child.Component("mailer")
+
+	component.PrintInfo("dropped", nil)
+	component.PrintWarn("kept", nil)
+
+	// Children share the level of the logger they were made from, in both directions.
+	component.SetLevel(LevelDebug)
+	if got := logger.Level(); got != LevelDebug {
+		t.Errorf("got level %s; want DEBUG", got)
+	}
+	child.PrintDebug("debug", nil)
+	logger.SetLevel(LevelOff)
+	component.PrintError(errors.New("dropped"), nil)
+
+	got := entries(t, &buf)
+	if len(got) != 2 || got[0].Message != "kept" || got[0].Level != "WARN" || got[1].Message != "debug" || got[1].Level != "DEBUG" {
+		t.Errorf("got entries %+v", got)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	parent := logger.With(map[string]any{"request_id": "abc-123", "user_id": int64(1)})
+	child := parent.Component("tracer")
+
+	child.PrintInfo("exported", map[string]any{"spans": 3, "user_id": int64(2), "ratio": 0.5, "ok": true})
+	parent.PrintInfo("served", nil)
+	logger.PrintInfo("started", nil)
+
+	got := entries(t, &buf)
+	if len(got) != 3 {
+		t.Fatalf("got %d entries; want 3", len(got))
+	}
+
+	// Properties of an entry take precedence over the logger's, and keep their JSON types.
+	want := map[string]any{"request_id": "abc-123", "component": "tracer", "user_id": float64(2), "spans": float64(3), "ratio": 0.5, "ok": true}
+	if len(got[0].Properties) != len(want) {
+		t.Errorf("got properties %v; want %v", got[0].Properties, want)
+	}
+	for key, value := range want {
+		if got[0].Properties[key] != value {
+			t.Errorf("got %s %v; want %v", key, got[0].Properties[key], value)
+		}
+	}
+
+	// Making a child leaves its parent's properties alone.
+	if _, ok := got[1].Properties["component"]; ok || got[1].Properties["user_id"] != float64(1) {
+		t.Errorf("got parent properties %v", got[1].Properties)
+	}
+	if got[2].Properties != nil {
+		t.Errorf("got root properties %v; want none", got[2].Properties)
+	}
+}
+
+func TestStackTraceLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelDebug)
+	child := logger.Component("healthz")
+
+	child.PrintWarn("warning", nil)
+	child.PrintError(errors.New("error"), nil)
+	logger.SetStackTraceLevel(LevelWarn)
+	child.PrintWarn("warning", nil)
+	logger.SetStackTraceLevel(LevelOff)
+	child.PrintError(errors.New("error"), nil)
+
+	// Stack traces are captured for errors by default, and not at all once turned off.
+	got := entries(t, &buf)
+	if len(got) != 4 {
+		t.Fatalf("got %d entries; want 4", len(got))
+	}
+	for i, wantTrace := range []bool{false, true, true, false} {
+		if (got[i].Trace != "") != wantTrace {
+			t.Errorf("got entry %d %s with trace %t; want %t", i, got[i].Level, got[i].Trace != "", wantTrace)
+		}
+	}
+}
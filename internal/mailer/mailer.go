@@ -2,7 +2,9 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"github.com/danyelkeddah/go-greenlight/internal/trace"
 	"github.com/go-mail/mail/v2"
 	"html/template"
 	"time"
@@ -16,17 +18,26 @@ type Mailer struct {
 	sender string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
+func New(host string, port int, username, password, sender string) *Mailer {
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	return Mailer{
+	return &Mailer{
 		dialer: dialer,
 		sender: sender,
 	}
 }
 
-func (m *Mailer) Send(recipient, templateFile string, data any) error {
+// Send renders the template and delivers the email, trying up to three times. ctx only
+// carries the span of the request the email was sent for: delivery is never cancelled, as it
+// usually outlives the request.
+func (m *Mailer) Send(ctx context.Context, recipient, templateFile string, data any) (err error) {
+	ctx, span := trace.Start(ctx, "Mailer.Send", trace.KindInternal, trace.String("mail.template", templateFile))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
 		return err
@@ -57,7 +68,7 @@ func (m *Mailer) Send(recipient, templateFile string, data any) error {
 	msg.AddAlternative("text/html", htmlBody.String())
 
 	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
+		err = m.dialAndSend(ctx, msg, i)
 		if nil == err {
 			return nil
 		}
@@ -66,3 +77,17 @@ func (m *Mailer) Send(recipient, templateFile string, data any) error {
 
 	return err
 }
+
+// dialAndSend makes a single attempt at delivering msg, recorded as a span of its own.
+func (m *Mailer) dialAndSend(ctx context.Context, msg *mail.Message, attempt int) error {
+	_, span := trace.Start(ctx, "smtp "+m.dialer.Host, trace.KindClient,
+		trace.String("server.address", m.dialer.Host),
+		trace.Int("server.port", m.dialer.Port),
+		trace.Int("mail.attempt", attempt),
+	)
+	defer span.End()
+
+	err := m.dialer.DialAndSend(msg)
+	span.RecordError(err)
+	return err
+}
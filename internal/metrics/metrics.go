@@ -0,0 +1,386 @@
+// Package metrics implements the counters, gauges and histograms the API exports, and
+// writes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the upper bounds, in seconds, of the buckets of a latency histogram.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a metric computed when the metrics are scraped.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// metric is a family of time series sharing a name, such as a CounterVec.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exported by an application.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds m, panicking if its name is taken, as that is a programming error.
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format, in the order they
+// were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the metrics to a Prometheus scraper.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// atomicFloat is a float64 which can be updated from several goroutines.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(value float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(value))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// Counter is a value which only goes up, such as a number of requests.
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.value.add(delta)
+}
+
+// Gauge is a value which can go up and down, such as a number of running tasks.
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Inc()              { g.value.add(1) }
+func (g *Gauge) Dec()              { g.value.add(-1) }
+func (g *Gauge) Add(delta float64) { g.value.add(delta) }
+func (g *Gauge) Set(value float64) { g.value.set(value) }
+
+// Histogram counts observations, such as request latencies, in buckets.
+type Histogram struct {
+	upperBounds []float64
+	// counts holds the number of observations in each bucket, and a last one for those
+	// above the largest upper bound.
+	counts []uint64
+	sum    atomicFloat
+}
+
+func newHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{upperBounds: upperBounds, counts: make([]uint64, len(upperBounds)+1)}
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	atomic.AddUint64(&h.counts[i], 1)
+	h.sum.add(value)
+}
+
+// vec holds the children of a metric, one for each combination of label values.
+type vec[T any] struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	newChild   func() *T
+	writeChild func(w *bufio.Writer, labels string, child *T)
+
+	mu       sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+}
+
+func (v *vec[T]) with(labelValues ...string) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	child = v.newChild()
+	v.children[key] = child
+	v.values[key] = append([]string(nil), labelValues...)
+	return child
+}
+
+func (v *vec[T]) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, v.typ)
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.writeChild(w, formatLabels(v.labelNames, v.values[key]), v.children[key])
+	}
+}
+
+// CounterVec is a counter partitioned by labels, such as the method and status of requests.
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{
+		name:       name,
+		help:       help,
+		typ:        "counter",
+		labelNames: labelNames,
+		newChild:   func() *Counter { return &Counter{} },
+		writeChild: func(w *bufio.Writer, labels string, child *Counter) {
+			writeSample(w, name, labels, child.value.load())
+		},
+		children: make(map[string]*Counter),
+		values:   make(map[string][]string),
+	}}
+	r.register(name, c)
+	return c
+}
+
+// With returns the counter for the given label values, in the order of the label names.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.with(labelValues...)
+}
+
+// NewCounter returns a counter without labels.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{vec[Gauge]{
+		name:       name,
+		help:       help,
+		typ:        "gauge",
+		labelNames: labelNames,
+		newChild:   func() *Gauge { return &Gauge{} },
+		writeChild: func(w *bufio.Writer, labels string, child *Gauge) {
+			writeSample(w, name, labels, child.value.load())
+		},
+		children: make(map[string]*Gauge),
+		values:   make(map[string][]string),
+	}}
+	r.register(name, g)
+	return g
+}
+
+// With returns the gauge for the given label values, in the order of the label names.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.with(labelValues...)
+}
+
+// NewGauge returns a gauge without labels.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// NewHistogramVec returns a histogram with buckets bounded by upperBounds, which must be
+// sorted in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, upperBounds []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{vec[Histogram]{
+		name:       name,
+		help:       help,
+		typ:        "histogram",
+		labelNames: labelNames,
+		newChild:   func() *Histogram { return newHistogram(upperBounds) },
+		writeChild: func(w *bufio.Writer, labels string, child *Histogram) {
+			var cumulative uint64
+			for i, bound := range child.upperBounds {
+				cumulative += atomic.LoadUint64(&child.counts[i])
+				writeSample(w, name+"_bucket", withLabel(labels, "le", formatValue(bound)), float64(cumulative))
+			}
+			cumulative += atomic.LoadUint64(&child.counts[len(child.upperBounds)])
+			writeSample(w, name+"_bucket", withLabel(labels, "le", "+Inf"), float64(cumulative))
+			writeSample(w, name+"_sum", labels, child.sum.load())
+			writeSample(w, name+"_count", labels, float64(cumulative))
+		},
+		children: make(map[string]*Histogram),
+		values:   make(map[string][]string),
+	}}
+	r.register(name, h)
+	return h
+}
+
+// With returns the histogram for the given label values, in the order of the label names.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.with(labelValues...)
+}
+
+// funcMetric computes its samples when the metrics are scraped.
+type funcMetric struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	collect    func() []Sample
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	for _, sample := range f.collect() {
+		writeSample(w, f.name, formatLabels(f.labelNames, sample.LabelValues), sample.Value)
+	}
+}
+
+// NewGaugeFunc registers a gauge whose samples are returned by collect on every scrape, such
+// as the statistics of a connection pool.
+func (r *Registry) NewGaugeFunc(name, help string, labelNames []string, collect func() []Sample) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "gauge", labelNames: labelNames, collect: collect})
+}
+
+// NewCounterFunc registers a counter whose samples are returned by collect on every scrape.
+func (r *Registry) NewCounterFunc(name, help string, labelNames []string, collect func() []Sample) {
+	r.register(name, &funcMetric{name: name, help: help, typ: "counter", labelNames: labelNames, collect: collect})
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatValue(value) + "\n")
+}
+
+// formatLabels returns labels in the form a="1",b="2", without the braces.
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func withLabel(labels, name, value string) string {
+	if labels == "" {
+		return name + `="` + value + `"`
+	}
+	return labels + "," + name + `="` + value + `"`
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
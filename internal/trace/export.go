@@ -0,0 +1,213 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WriterExporter writes every span as a line of JSON, for reading traces without a
+// collector, for example on stdout during development.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func (e *WriterExporter) Export(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, span := range spans {
+		attributes := make(map[string]any, len(span.Attributes))
+		for _, attribute := range span.Attributes {
+			attributes[attribute.Key] = attribute.Value
+		}
+
+		line := struct {
+			Name         string         `json:"name"`
+			Kind         string         `json:"kind"`
+			TraceID      string         `json:"trace_id"`
+			SpanID       string         `json:"span_id"`
+			ParentSpanID string         `json:"parent_span_id,omitempty"`
+			Start        time.Time      `json:"start"`
+			DurationMS   float64        `json:"duration_ms"`
+			Attributes   map[string]any `json:"attributes,omitempty"`
+			Error        string         `json:"error,omitempty"`
+		}{
+			Name:       span.Name,
+			Kind:       span.Kind.String(),
+			TraceID:    span.TraceID.String(),
+			SpanID:     span.SpanID.String(),
+			Start:      span.Start.UTC(),
+			DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+			Attributes: attributes,
+			Error:      span.Error,
+		}
+		if span.ParentSpanID.IsValid() {
+			line.ParentSpanID = span.ParentSpanID.String()
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP, encoded as JSON.
+type OTLPExporter struct {
+	endpoint string
+	resource []otlpKeyValue
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to endpoint, the full URL of the collector's
+// traces receiver such as http://localhost:4318/v1/traces. The resource attributes, such as
+// service.name, describe the process the spans come from.
+func NewOTLPExporter(endpoint string, resource ...Attribute) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		resource: otlpAttributes(resource),
+		client:   &http.Client{},
+	}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/danyelkeddah/go-greenlight/internal/trace"}}
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              int(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.ParentSpanID.IsValid() {
+			s.ParentSpanID = span.ParentSpanID.String()
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: e.resource},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("trace: exporting %d spans to %s failed: %s", len(spans), e.endpoint, res.Status)
+	}
+
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest, in which IDs
+// are hex strings and 64-bit integers are decimal strings.
+
+const otlpStatusError = 2
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func otlpAttributes(attributes []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for _, attribute := range attributes {
+		var value otlpAnyValue
+		switch v := attribute.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: attribute.Key, Value: value})
+	}
+	return kvs
+}
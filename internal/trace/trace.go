@@ -0,0 +1,432 @@
+// Package trace records spans for the work done to serve a request, propagates traces with
+// the W3C traceparent header, and exports the spans in batches, for example over OTLP/HTTP.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace, which is every span recorded for a single request.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+// SpanContext is the part of a span propagated to other processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the span context as the value of a traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses the value of a traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Headers of a later version are
+// read as far as version 00 goes, as the specification asks.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	for _, field := range []struct {
+		text string
+		dst  []byte
+	}{
+		{parts[0], make([]byte, 1)},
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], flags[:]},
+	} {
+		// Only lowercase hex digits are allowed.
+		if len(field.text) != 2*len(field.dst) || strings.ToLower(field.text) != field.text {
+			return SpanContext{}, false
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.text)); err != nil {
+			return SpanContext{}, false
+		}
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// SpanKind describes the relationship of a span to the other spans of its trace. The values
+// are those of OTLP.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case KindServer:
+		return "server"
+	case KindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+// Attribute is a key and a value, which is a string, int64, float64 or bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, value string) Attribute          { return Attribute{key, value} }
+func Int(key string, value int) Attribute         { return Attribute{key, int64(value)} }
+func Int64(key string, value int64) Attribute     { return Attribute{key, value} }
+func Float64(key string, value float64) Attribute { return Attribute{key, value} }
+func Bool(key string, value bool) Attribute       { return Attribute{key, value} }
+
+// SpanData is a finished span, as handed to an Exporter.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error describes why the span failed, and is empty for spans which succeeded.
+	Error string
+}
+
+// Span is an operation within a trace. Start returns a nil Span when there is nothing to
+// record, and all the methods of a nil Span do nothing, so callers never need to check.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  SpanID
+	kind    SpanKind
+	start   time.Time
+
+	mu         sync.Mutex
+	name       string
+	attributes []Attribute
+	err        string
+	ended      bool
+}
+
+// SpanContext returns the span's context, or the zero SpanContext for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// IsRecording reports whether the span will be exported once it ends.
+func (s *Span) IsRecording() bool {
+	return s != nil && s.context.Sampled
+}
+
+// SetName replaces the name of the span, for example once a request has been routed.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// RecordError marks the span as failed because of err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export. Only the first call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		Name:         s.name,
+		Kind:         s.kind,
+		TraceID:      s.context.TraceID,
+		SpanID:       s.context.SpanID,
+		ParentSpanID: s.parent,
+		Start:        s.start,
+		End:          time.Now(),
+		Attributes:   s.attributes,
+		Error:        s.err,
+	}
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span as the parent of the spans started
+// from it.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the span ctx carries, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Detach returns a context carrying only the span of ctx, for work which outlives the
+// request it was started by, such as sending an email in the background, and so mustn't be
+// cancelled along with it.
+func Detach(ctx context.Context) context.Context {
+	return ContextWithSpan(context.Background(), SpanFromContext(ctx))
+}
+
+// Start begins a span as a child of the span ctx carries, recorded by the same tracer. When
+// ctx carries no recorded span it returns ctx and a nil Span, so code deep in the
+// application can be traced without knowing whether tracing is enabled.
+func Start(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, kind, parent.context, attributes)
+}
+
+// Exporter sends finished spans to wherever they are stored.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Options configure a Tracer. Zero values select the defaults, apart from SampleRate.
+type Options struct {
+	// SampleRate is the fraction of new traces which are recorded. Traces continued from a
+	// traceparent header are recorded if the caller recorded its part of them.
+	SampleRate float64
+	// QueueSize is the number of finished spans waiting to be exported, beyond which more
+	// are dropped. It defaults to 2048.
+	QueueSize int
+	// BatchSize is the largest number of spans exported at once. It defaults to 512.
+	BatchSize int
+	// BatchTimeout is the longest time a span waits to be exported. It defaults to 5s.
+	BatchTimeout time.Duration
+	// ExportTimeout bounds every call to the exporter. It defaults to 10s.
+	ExportTimeout time.Duration
+	// OnError is called with the errors returned by the exporter.
+	OnError func(error)
+}
+
+// Tracer starts spans and exports them in batches from a background goroutine. A nil
+// Tracer records nothing.
+type Tracer struct {
+	exporter Exporter
+	options  Options
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan SpanData
+	done   chan struct{}
+
+	dropped atomic.Int64
+}
+
+// New returns a Tracer exporting its spans through exporter. Call Shutdown to export the
+// spans still queued before the application exits.
+func New(exporter Exporter, options Options) *Tracer {
+	if options.QueueSize <= 0 {
+		options.QueueSize = 2048
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 512
+	}
+	if options.BatchTimeout <= 0 {
+		options.BatchTimeout = 5 * time.Second
+	}
+	if options.ExportTimeout <= 0 {
+		options.ExportTimeout = 10 * time.Second
+	}
+
+	t := &Tracer{
+		exporter: exporter,
+		options:  options,
+		queue:    make(chan SpanData, options.QueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+// Start begins a span. Its parent is the span ctx carries if there is one, or else remote,
+// such as the caller's span propagated in a traceparent header. Without either, the span
+// starts a new trace, which is recorded according to the sample rate.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, remote SpanContext, attributes ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent := remote
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.context
+	}
+	if !parent.IsValid() {
+		parent = SpanContext{Sampled: mathrand.Float64() < t.options.SampleRate}
+		rand.Read(parent.TraceID[:])
+	}
+
+	return t.start(ctx, name, kind, parent, attributes)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind SpanKind, parent SpanContext, attributes []Attribute) (context.Context, *Span) {
+	span := &Span{
+		tracer:     t,
+		context:    SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled},
+		parent:     parent.SpanID,
+		kind:       kind,
+		start:      time.Now(),
+		name:       name,
+		attributes: attributes,
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// Dropped returns the number of spans dropped because the export queue was full.
+func (t *Tracer) Dropped() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.dropped.Load()
+}
+
+// enqueue never blocks the request which finished the span; if the exporter can't keep up
+// the span is dropped instead.
+func (t *Tracer) enqueue(span SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		t.dropped.Add(1)
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.options.BatchTimeout)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= t.options.BatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *Tracer) export(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.options.ExportTimeout)
+	defer cancel()
+
+	err := t.exporter.Export(ctx, batch)
+	if err != nil && t.options.OnError != nil {
+		t.options.OnError(err)
+	}
+}
+
+// Shutdown stops the tracer and waits until the spans still queued have been exported, or
+// ctx is done. Spans which end afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
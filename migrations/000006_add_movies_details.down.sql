@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS movies_release_date_idx;
+DROP INDEX IF EXISTS movies_rating_idx;
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_release_date_check;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_rating_check;
+
+ALTER TABLE movies DROP COLUMN IF EXISTS original_language;
+ALTER TABLE movies DROP COLUMN IF EXISTS release_date;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating;
+ALTER TABLE movies DROP COLUMN IF EXISTS synopsis;
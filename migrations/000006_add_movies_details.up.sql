@@ -0,0 +1,10 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS synopsis text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS release_date date;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS original_language text NOT NULL DEFAULT '';
+
+ALTER TABLE movies ADD CONSTRAINT movies_rating_check CHECK (rating IN ('', 'G', 'PG', 'PG-13', 'R', 'NC-17'));
+ALTER TABLE movies ADD CONSTRAINT movies_release_date_check CHECK (release_date IS NULL OR release_date >= '1888-01-01');
+
+CREATE INDEX IF NOT EXISTS movies_rating_idx ON movies (rating);
+CREATE INDEX IF NOT EXISTS movies_release_date_idx ON movies (release_date);
@@ -0,0 +1,14 @@
+-- user_id is 0 for keys sent by anonymous users, so it can't reference the users table.
+-- status, header and body stay NULL while the request holding the key is in progress.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text NOT NULL,
+    user_id bigint NOT NULL,
+    request_hash bytea NOT NULL,
+    status integer,
+    header jsonb,
+    body bytea,
+    expiry timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
@@ -0,0 +1,17 @@
+// Package migrations embeds the SQL migrations into the binary, so the API can migrate its
+// database without the migrations directory being present at runtime.
+package migrations
+
+import (
+	"embed"
+)
+
+// FS holds the PostgreSQL migrations at its root and the SQLite migrations in "sqlite".
+//
+//go:embed *.sql sqlite/*.sql
+var FS embed.FS
+
+const (
+	PostgresDir = "."
+	SQLiteDir   = "sqlite"
+)
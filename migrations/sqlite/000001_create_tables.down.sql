@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS users;
+DROP TRIGGER IF EXISTS movies_fts_update;
+DROP TRIGGER IF EXISTS movies_fts_delete;
+DROP TRIGGER IF EXISTS movies_fts_insert;
+DROP TABLE IF EXISTS movies_fts;
+DROP TABLE IF EXISTS movie_genres;
+DROP TABLE IF EXISTS movies;
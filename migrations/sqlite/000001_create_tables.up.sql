@@ -0,0 +1,61 @@
+CREATE TABLE IF NOT EXISTS movies (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title TEXT NOT NULL,
+    year INTEGER NOT NULL CHECK (year BETWEEN 1888 AND 9999),
+    runtime INTEGER NOT NULL CHECK (runtime >= 0),
+    synopsis TEXT NOT NULL DEFAULT '',
+    rating TEXT NOT NULL DEFAULT '' CHECK (rating IN ('', 'G', 'PG', 'PG-13', 'R', 'NC-17')),
+    release_date TEXT CHECK (release_date IS NULL OR release_date >= '1888-01-01'),
+    original_language TEXT NOT NULL DEFAULT '',
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS movies_rating_idx ON movies (rating);
+CREATE INDEX IF NOT EXISTS movies_release_date_idx ON movies (release_date);
+
+-- SQLite has no array type, so genres live in a join table. position keeps them in the
+-- order the client sent them.
+CREATE TABLE IF NOT EXISTS movie_genres (
+    movie_id INTEGER NOT NULL REFERENCES movies ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    genre TEXT NOT NULL,
+    PRIMARY KEY (movie_id, position),
+    UNIQUE (movie_id, genre)
+);
+
+CREATE INDEX IF NOT EXISTS movie_genres_genre_idx ON movie_genres (genre);
+
+-- Full-text index over movie titles, kept in sync with the movies table by triggers.
+CREATE VIRTUAL TABLE IF NOT EXISTS movies_fts USING fts5 (title, content = 'movies', content_rowid = 'id');
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_insert AFTER INSERT ON movies BEGIN
+    INSERT INTO movies_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_delete AFTER DELETE ON movies BEGIN
+    INSERT INTO movies_fts (movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS movies_fts_update AFTER UPDATE OF title ON movies BEGIN
+    INSERT INTO movies_fts (movies_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO movies_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    name TEXT NOT NULL,
+    email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash BLOB NOT NULL,
+    activated INTEGER NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+-- expiry is stored as a unix timestamp so it can be compared numerically.
+CREATE TABLE IF NOT EXISTS tokens (
+    hash BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry INTEGER NOT NULL,
+    scope TEXT NOT NULL
+);
@@ -0,0 +1,15 @@
+-- user_id is 0 for keys sent by anonymous users, so it can't reference the users table.
+-- status, header and body stay NULL while the request holding the key is in progress, and
+-- expiry is a unix timestamp like the expiry of tokens.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    request_hash BLOB NOT NULL,
+    status INTEGER,
+    header TEXT,
+    body BLOB,
+    expiry INTEGER NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);